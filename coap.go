@@ -0,0 +1,347 @@
+/*
+ * Copyright (c) 2022 Deomid "rojer" Ryabkov
+ * All rights reserved
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	klog "k8s.io/klog/v2"
+)
+
+// Minimal CoAP (RFC 7252) server that accepts log lines POSTed or PUT to /log.
+// Large batches can be sent with block-wise transfer (RFC 7959, Block1).
+
+const coapDefaultPort = 5683
+
+// CoAP message types.
+const (
+	coapCON = 0
+	coapNON = 1
+	coapACK = 2
+	coapRST = 3
+)
+
+// CoAP codes, class << 5 | detail.
+const (
+	coapEmpty             = 0x00
+	coapPOST              = 0x02
+	coapPUT               = 0x03
+	coapChanged           = 0x44 // 2.04
+	coapContinue          = 0x5f // 2.31
+	coapBadRequest        = 0x80 // 4.00
+	coapNotFound          = 0x84 // 4.04
+	coapMethodNotAllowed  = 0x85 // 4.05
+	coapRequestIncomplete = 0x88 // 4.08
+	coapRequestTooLarge   = 0x8d // 4.13
+)
+
+const (
+	coapOptionUriPath = 11
+	coapOptionBlock1  = 27
+)
+
+// Retransmissions and block-wise transfers are tracked for this long.
+const coapExchangeLifetime = 247 * time.Second
+
+type coapMessage struct {
+	typ     byte
+	code    byte
+	mid     uint16
+	token   []byte
+	opts    []coapOption
+	payload []byte
+}
+
+type coapOption struct {
+	num   int
+	value []byte
+}
+
+// coapPeer is the state of a client: last response for retransmissions and the block-wise transfer in progress.
+type coapPeer struct {
+	lastSeen time.Time
+	lastMID  uint16
+	lastResp []byte
+	body     []byte
+	nextNum  uint32
+}
+
+type coapInput struct {
+	c   *net.UDPConn
+	tag string
+
+	mu        sync.Mutex
+	peers     map[string]*coapPeer
+	lastSweep time.Time
+}
+
+func listenCoAP(network, hostPort, tag string) (*coapInput, error) {
+	if _, _, err := net.SplitHostPort(hostPort); err != nil {
+		hostPort = net.JoinHostPort(strings.Trim(hostPort, "[]"), strconv.Itoa(coapDefaultPort))
+	}
+	addr, err := net.ResolveUDPAddr(network, hostPort)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	c, err := net.ListenUDP(network, addr)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err := setRcvBuf(c); err != nil {
+		c.Close()
+		return nil, errors.Trace(err)
+	}
+	klog.Infof("Listening for CoAP on %s...", c.LocalAddr())
+	return &coapInput{c: c, tag: tag, peers: make(map[string]*coapPeer)}, nil
+}
+
+func (in *coapInput) Run(wp *WorkerPool) error {
+	buf := make([]byte, 65536)
+	for {
+		n, src, err := in.c.ReadFromUDP(buf)
+		if err != nil {
+			return errors.Annotatef(err, "socket read error")
+		}
+		rxPackets.Add(1)
+		rxBytes.Add(int64(n))
+		req, err := parseCoAP(buf[:n])
+		if err != nil {
+			klog.V(1).Infof("%s: invalid CoAP message: %v", src, err)
+			continue
+		}
+		if resp := in.handle(time.Now(), src, req, wp); resp != nil {
+			in.c.WriteToUDP(resp, src)
+		}
+	}
+}
+
+func (in *coapInput) Close() error {
+	return in.c.Close()
+}
+
+func (in *coapInput) handle(now time.Time, src *net.UDPAddr, req *coapMessage, wp *WorkerPool) []byte {
+	if req.typ == coapACK || req.typ == coapRST {
+		return nil
+	}
+	if req.code == coapEmpty {
+		// CoAP ping.
+		if req.typ == coapCON {
+			return (&coapMessage{typ: coapRST, mid: req.mid}).marshal()
+		}
+		return nil
+	}
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if now.Sub(in.lastSweep) > coapExchangeLifetime {
+		for k, p := range in.peers {
+			if now.Sub(p.lastSeen) > coapExchangeLifetime {
+				delete(in.peers, k)
+			}
+		}
+		in.lastSweep = now
+	}
+	key := src.String()
+	peer := in.peers[key]
+	if peer == nil {
+		peer = &coapPeer{}
+		in.peers[key] = peer
+	} else if req.typ == coapCON && req.mid == peer.lastMID && peer.lastResp != nil {
+		// Retransmission, our response was lost.
+		return peer.lastResp
+	}
+	peer.lastSeen = now
+	code, block1, lines := in.process(peer, req)
+	if lines != nil {
+		if lines[len(lines)-1] != '\n' {
+			lines = append(lines, '\n')
+		}
+		wp.EnqueueWait(&packet{ts: now, src: src, data: lines, listener: in.tag})
+	}
+	resp := &coapMessage{typ: coapACK, code: code, mid: req.mid, token: req.token}
+	if req.typ == coapNON {
+		resp.typ, resp.mid = coapNON, uint16(now.UnixNano())
+	}
+	if block1 != nil {
+		resp.opts = append(resp.opts, coapOption{num: coapOptionBlock1, value: block1})
+	}
+	b := resp.marshal()
+	if req.typ == coapCON {
+		peer.lastMID, peer.lastResp = req.mid, b
+	}
+	return b
+}
+
+// process handles a request, returns the response code, Block1 option to echo and complete payload, if any.
+func (in *coapInput) process(peer *coapPeer, req *coapMessage) (byte, []byte, []byte) {
+	if req.code != coapPOST && req.code != coapPUT {
+		return coapMethodNotAllowed, nil, nil
+	}
+	var path []string
+	var block1 []byte
+	for _, o := range req.opts {
+		switch o.num {
+		case coapOptionUriPath:
+			path = append(path, string(o.value))
+		case coapOptionBlock1:
+			block1 = o.value
+		}
+	}
+	if len(path) != 1 || path[0] != "log" {
+		return coapNotFound, nil, nil
+	}
+	if block1 == nil {
+		peer.body, peer.nextNum = nil, 0
+		if len(req.payload) == 0 {
+			return coapChanged, nil, nil
+		}
+		return coapChanged, nil, append([]byte(nil), req.payload...)
+	}
+	if len(block1) > 3 {
+		return coapBadRequest, nil, nil
+	}
+	var v uint32
+	for _, b := range block1 {
+		v = v<<8 | uint32(b)
+	}
+	num, more, szx := v>>4, v&0x8 != 0, v&0x7
+	if szx == 7 {
+		return coapBadRequest, nil, nil
+	}
+	if num != peer.nextNum {
+		peer.body, peer.nextNum = nil, 0
+		return coapRequestIncomplete, nil, nil
+	}
+	// Blocks other than the last one must be full size.
+	if more && len(req.payload) != 1<<(int(szx)+4) {
+		return coapBadRequest, nil, nil
+	}
+	if len(peer.body)+len(req.payload) > maxStreamLineLen {
+		peer.body, peer.nextNum = nil, 0
+		return coapRequestTooLarge, nil, nil
+	}
+	peer.body = append(peer.body, req.payload...)
+	if more {
+		peer.nextNum++
+		return coapContinue, block1, nil
+	}
+	body := peer.body
+	peer.body, peer.nextNum = nil, 0
+	if len(body) == 0 {
+		return coapChanged, block1, nil
+	}
+	return coapChanged, block1, body
+}
+
+func parseCoAP(b []byte) (*coapMessage, error) {
+	if len(b) < 4 {
+		return nil, errors.Errorf("message is too short")
+	}
+	if b[0]>>6 != 1 {
+		return nil, errors.Errorf("unsupported version %d", b[0]>>6)
+	}
+	m := &coapMessage{typ: (b[0] >> 4) & 3, code: b[1], mid: binary.BigEndian.Uint16(b[2:4])}
+	tkl := int(b[0] & 0xf)
+	if tkl > 8 || len(b) < 4+tkl {
+		return nil, errors.Errorf("invalid token length")
+	}
+	m.token = b[4 : 4+tkl]
+	b = b[4+tkl:]
+	num := 0
+	for len(b) > 0 {
+		if b[0] == 0xff {
+			if len(b) == 1 {
+				return nil, errors.Errorf("empty payload after marker")
+			}
+			m.payload = b[1:]
+			break
+		}
+		delta, length := int(b[0]>>4), int(b[0]&0xf)
+		b = b[1:]
+		var err error
+		if delta, b, err = coapOptExt(delta, b); err != nil {
+			return nil, err
+		}
+		if length, b, err = coapOptExt(length, b); err != nil {
+			return nil, err
+		}
+		if len(b) < length {
+			return nil, errors.Errorf("truncated option")
+		}
+		num += delta
+		m.opts = append(m.opts, coapOption{num: num, value: b[:length]})
+		b = b[length:]
+	}
+	return m, nil
+}
+
+// coapOptExt decodes extended option delta or length.
+func coapOptExt(v int, b []byte) (int, []byte, error) {
+	switch v {
+	case 13:
+		if len(b) < 1 {
+			return 0, nil, errors.Errorf("truncated option")
+		}
+		return int(b[0]) + 13, b[1:], nil
+	case 14:
+		if len(b) < 2 {
+			return 0, nil, errors.Errorf("truncated option")
+		}
+		return int(binary.BigEndian.Uint16(b)) + 269, b[2:], nil
+	case 15:
+		return 0, nil, errors.Errorf("invalid option")
+	}
+	return v, b, nil
+}
+
+func (m *coapMessage) marshal() []byte {
+	b := []byte{1<<6 | m.typ<<4 | byte(len(m.token)), m.code, byte(m.mid >> 8), byte(m.mid)}
+	b = append(b, m.token...)
+	prev := 0
+	for _, o := range m.opts {
+		delta, dext := coapOptNibble(o.num - prev)
+		length, lext := coapOptNibble(len(o.value))
+		b = append(b, delta<<4|length)
+		b = append(b, dext...)
+		b = append(b, lext...)
+		b = append(b, o.value...)
+		prev = o.num
+	}
+	if len(m.payload) > 0 {
+		b = append(b, 0xff)
+		b = append(b, m.payload...)
+	}
+	return b
+}
+
+// coapOptNibble encodes option delta or length, returns the nibble and the extended bytes.
+func coapOptNibble(v int) (byte, []byte) {
+	switch {
+	case v < 13:
+		return byte(v), nil
+	case v < 269:
+		return 13, []byte{byte(v - 13)}
+	default:
+		return 14, []byte{byte((v - 269) >> 8), byte(v - 269)}
+	}
+}
@@ -0,0 +1,51 @@
+/*
+ * Copyright (c) 2022 Deomid "rojer" Ryabkov
+ * All rights reserved
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"os"
+
+	"github.com/juju/errors"
+)
+
+const colorReset = "\x1b[0m"
+
+// ANSI color sequences for levels, levels not listed here are not colored.
+var levelColors = map[string]string{
+	"E": "\x1b[31m", // Red
+	"W": "\x1b[33m", // Yellow
+	"D": "\x1b[36m", // Cyan
+	"V": "\x1b[90m", // Gray
+}
+
+// useColor decides whether to color the output based on the --color setting.
+func useColor(mode string, f *os.File) (bool, error) {
+	switch mode {
+	case "always":
+		return true, nil
+	case "never":
+		return false, nil
+	case "auto":
+		st, err := f.Stat()
+		if err != nil {
+			return false, nil
+		}
+		return st.Mode()&os.ModeCharDevice != 0, nil
+	}
+	return false, errors.Errorf("invalid color mode %q, must be auto, always or never", mode)
+}
@@ -0,0 +1,71 @@
+/*
+ * Copyright (c) 2022 Deomid "rojer" Ryabkov
+ * All rights reserved
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+
+	"github.com/juju/errors"
+)
+
+// Maximum size of a decompressed datagram.
+const maxDecompressedLen = 1024 * 1024
+
+// decompressPayload decompresses the datagram according to mode: none, gzip, zlib, deflate or auto.
+// In auto mode gzip and zlib payloads are detected by their headers, anything else is returned as is.
+func decompressPayload(mode string, data []byte) ([]byte, error) {
+	var r io.ReadCloser
+	var err error
+	switch mode {
+	case "", "none":
+		return data, nil
+	case "auto":
+		switch {
+		case len(data) >= 2 && data[0] == 0x1f && data[1] == 0x8b:
+			r, err = gzip.NewReader(bytes.NewReader(data))
+		case len(data) >= 2 && data[0]&0x0f == 8 && (uint16(data[0])<<8|uint16(data[1]))%31 == 0:
+			r, err = zlib.NewReader(bytes.NewReader(data))
+		default:
+			return data, nil
+		}
+	case "gzip":
+		r, err = gzip.NewReader(bytes.NewReader(data))
+	case "zlib":
+		r, err = zlib.NewReader(bytes.NewReader(data))
+	case "deflate":
+		r = flate.NewReader(bytes.NewReader(data))
+	default:
+		return nil, errors.Errorf("unknown compression %q", mode)
+	}
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer r.Close()
+	res, err := io.ReadAll(io.LimitReader(r, maxDecompressedLen+1))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if len(res) > maxDecompressedLen {
+		return nil, errors.Errorf("decompressed payload is too big")
+	}
+	return res, nil
+}
@@ -0,0 +1,259 @@
+/*
+ * Copyright (c) 2022 Deomid "rojer" Ryabkov
+ * All rights reserved
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/juju/errors"
+	flag "github.com/spf13/pflag"
+	klog "k8s.io/klog/v2"
+)
+
+// Flags that are re-read from the config file on SIGHUP.
+var reloadableFlags = map[string]bool{
+	"stdout-format":        true,
+	"file-format":          true,
+	"file-name-template":   true,
+	"latest-name-template": true,
+	"combined-file":        true,
+	"min-level":            true,
+	"allow-devices":        true,
+	"deny-devices":         true,
+	"allow-streams":        true,
+	"deny-streams":         true,
+}
+
+// Flags set on the command line, these take precedence over the config file.
+var cliFlags = make(map[string]bool)
+
+// Settings that can be changed at run time.
+type dynConfig struct {
+	stdoutFmt recordFormat
+	tailFmt   recordFormat
+	devFilter *DeviceFilter
+	fdFilter  *DeviceFilter // Matches stream names.
+	minLevel  int
+}
+
+var dynCfg atomic.Value
+
+func getDynConfig() *dynConfig {
+	return dynCfg.Load().(*dynConfig)
+}
+
+func newDynConfig(rs *reloadable) (*dynConfig, error) {
+	cfg := &dynConfig{minLevel: rs.minLevel}
+	format, err := parseRecordFormat("stdout", rs.stdoutFormat)
+	if err != nil {
+		return nil, errors.Annotatef(err, "invalid --stdout-format template")
+	}
+	if *flagStdout {
+		cfg.stdoutFmt = format
+	}
+	cfg.tailFmt = format
+	if len(rs.allowDevices) > 0 || len(rs.denyDevices) > 0 {
+		if cfg.devFilter, err = NewDeviceFilter(rs.allowDevices, rs.denyDevices); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	if len(rs.allowStreams) > 0 || len(rs.denyStreams) > 0 {
+		if cfg.fdFilter, err = NewDeviceFilter(rs.allowStreams, rs.denyStreams); err != nil {
+			return nil, errors.Annotatef(err, "invalid stream filter")
+		}
+	}
+	return cfg, nil
+}
+
+// Values of reloadableFlags.
+// On reload the config is applied to a copy, flags are only updated once the new settings have been validated.
+type reloadable struct {
+	stdoutFormat string
+	fileFormat   string
+	fileNameTmpl string
+	latestTmpl   string
+	combinedFile string
+	minLevel     int
+	allowDevices []string
+	denyDevices  []string
+	allowStreams []string
+	denyStreams  []string
+}
+
+func currentReloadable() *reloadable {
+	return &reloadable{
+		stdoutFormat: *flagStdoutFormat,
+		fileFormat:   *flagFileFormat,
+		fileNameTmpl: *flagFileNameTmpl,
+		latestTmpl:   *flagLatestTmpl,
+		combinedFile: *flagCombinedFile,
+		minLevel:     *flagMinLevel,
+		allowDevices: *flagAllowDevices,
+		denyDevices:  *flagDenyDevices,
+		allowStreams: *flagAllowStreams,
+		denyStreams:  *flagDenyStreams,
+	}
+}
+
+// flagSet returns a scratch flag set that stores values in rs.
+func (rs *reloadable) flagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet("reload", flag.ContinueOnError)
+	fs.StringVar(&rs.stdoutFormat, "stdout-format", rs.stdoutFormat, "")
+	fs.StringVar(&rs.fileFormat, "file-format", rs.fileFormat, "")
+	fs.StringVar(&rs.fileNameTmpl, "file-name-template", rs.fileNameTmpl, "")
+	fs.StringVar(&rs.latestTmpl, "latest-name-template", rs.latestTmpl, "")
+	fs.StringVar(&rs.combinedFile, "combined-file", rs.combinedFile, "")
+	fs.IntVar(&rs.minLevel, "min-level", rs.minLevel, "")
+	fs.StringSliceVar(&rs.allowDevices, "allow-devices", rs.allowDevices, "")
+	fs.StringSliceVar(&rs.denyDevices, "deny-devices", rs.denyDevices, "")
+	fs.StringSliceVar(&rs.allowStreams, "allow-streams", rs.allowStreams, "")
+	fs.StringSliceVar(&rs.denyStreams, "deny-streams", rs.denyStreams, "")
+	return fs
+}
+
+// fileManagerOptions returns file manager options with reloadable settings taken from rs.
+func (rs *reloadable) fileManagerOptions() *FileManagerOptions {
+	opts := fileManagerOptions()
+	opts.RecordFormat = rs.fileFormat
+	opts.NameTemplate = rs.fileNameTmpl
+	opts.LatestNameTemplate = rs.latestTmpl
+	opts.CombinedFile = rs.combinedFile
+	return opts
+}
+
+func (rs *reloadable) store() {
+	*flagStdoutFormat = rs.stdoutFormat
+	*flagFileFormat = rs.fileFormat
+	*flagFileNameTmpl = rs.fileNameTmpl
+	*flagLatestTmpl = rs.latestTmpl
+	*flagCombinedFile = rs.combinedFile
+	*flagMinLevel = rs.minLevel
+	*flagAllowDevices = rs.allowDevices
+	*flagDenyDevices = rs.denyDevices
+	*flagAllowStreams = rs.allowStreams
+	*flagDenyStreams = rs.denyStreams
+}
+
+// readConfigFile reads flag settings from a file, one "name = value" per line.
+// Empty lines and lines starting with # are ignored.
+// Repeated values of list flags are combined.
+func readConfigFile(fname string) (map[string][]string, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer f.Close()
+	res := make(map[string][]string)
+	sc := bufio.NewScanner(f)
+	for ln := 1; sc.Scan(); ln++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, found := strings.Cut(line, "=")
+		if !found {
+			return nil, errors.Errorf("%s:%d: expected name = value", fname, ln)
+		}
+		name = strings.TrimPrefix(strings.TrimSpace(name), "--")
+		if flag.Lookup(name) == nil {
+			return nil, errors.Errorf("%s:%d: unknown flag %q", fname, ln, name)
+		}
+		res[name] = append(res[name], strings.TrimSpace(value))
+	}
+	return res, errors.Trace(sc.Err())
+}
+
+// applyConfig sets flags in fs from the config that were not set on the command line.
+// If only is not nil, other flags are left alone and those not present in the config are reset to defaults.
+func applyConfig(fs *flag.FlagSet, cfg map[string][]string, only map[string]bool) error {
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || cliFlags[f.Name] || (only != nil && !only[f.Name]) {
+			return
+		}
+		values, found := cfg[f.Name]
+		if !found {
+			if only == nil {
+				return
+			}
+			if sv, ok := f.Value.(flag.SliceValue); ok {
+				err = sv.Replace(nil)
+			} else {
+				err = f.Value.Set(flag.Lookup(f.Name).DefValue)
+			}
+			return
+		}
+		if sv, ok := f.Value.(flag.SliceValue); ok {
+			var all []string
+			for _, v := range values {
+				all = append(all, strings.Split(v, ",")...)
+			}
+			err = sv.Replace(all)
+		} else {
+			err = f.Value.Set(values[len(values)-1])
+		}
+		if err != nil {
+			err = errors.Annotatef(err, "invalid value for %s", f.Name)
+		}
+	})
+	return err
+}
+
+// reloadOnSIGHUP re-reads the config file and applies reloadable settings when SIGHUP is received.
+// If anything fails, old settings remain in effect.
+func reloadOnSIGHUP(fm *FileManager) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP)
+	for range sigCh {
+		if err := reload(fm); err != nil {
+			klog.Errorf("Reload failed, keeping old settings: %v", err)
+		}
+	}
+}
+
+func reload(fm *FileManager) error {
+	rs := currentReloadable()
+	if *flagConfig != "" {
+		cfg, err := readConfigFile(*flagConfig)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if err := applyConfig(rs.flagSet(), cfg, reloadableFlags); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	newCfg, err := newDynConfig(rs)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if fm != nil {
+		if err := fm.SetTemplates(rs.fileManagerOptions()); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	rs.store()
+	dynCfg.Store(newCfg)
+	klog.Infof("Reloaded settings: stdout-format=%q file-format=%q file-name-template=%q latest-name-template=%q min-level=%d allow-devices=%q deny-devices=%q allow-streams=%q deny-streams=%q",
+		*flagStdoutFormat, *flagFileFormat, *flagFileNameTmpl, *flagLatestTmpl, *flagMinLevel, *flagAllowDevices, *flagDenyDevices, *flagAllowStreams, *flagDenyStreams)
+	return nil
+}
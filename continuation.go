@@ -0,0 +1,66 @@
+/*
+ * Copyright (c) 2022 Deomid "rojer" Ryabkov
+ * All rights reserved
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"net"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// lineJoiner processes lines from a single source, appending lines without
+// a valid header to the message of the preceding valid line.
+// The last valid line is held until the next one arrives or Flush is called.
+type lineJoiner struct {
+	listener   string
+	authDevice string // Device that signed or encrypted the packet.
+	prev       *LineInfo
+}
+
+func (lj *lineJoiner) Add(ts time.Time, src *net.UDPAddr, line []byte) error {
+	li, err := parseLine(ts, src, line)
+	if err != nil {
+		// Continuations must not smuggle in NUL bytes. In HMAC line mode each line is signed
+		// on its own, so lines without a header cannot be authenticated and are not joined.
+		if lj.prev != nil && checkNUL(line) == nil && (hmacVerifier == nil || hmacVerifier.packetMode) {
+			lj.prev.Msg += "\n" + string(line)
+			return nil
+		}
+		countParseError(ts, src, line, err)
+		if !*flagLenient {
+			return errors.Trace(err)
+		}
+		li = rawLineInfo(ts, src, line, err)
+	}
+	li.Listener = lj.listener
+	lj.Flush()
+	if reason := checkAuth(li, line, lj.authDevice); reason != "" {
+		countDrop(li, reason)
+		return nil
+	}
+	lj.prev = li
+	return nil
+}
+
+func (lj *lineJoiner) Flush() {
+	if lj.prev != nil {
+		handleLine(lj.prev)
+		lj.prev = nil
+	}
+}
@@ -0,0 +1,95 @@
+/*
+ * Copyright (c) 2022 Deomid "rojer" Ryabkov
+ * All rights reserved
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/hex"
+
+	"github.com/juju/errors"
+)
+
+// PayloadDecryptor decrypts packets encrypted with per-device AES-GCM keys.
+// An encrypted packet is framed as:
+//
+//	#enc device_id <12 byte nonce><ciphertext and tag>
+//
+// The device ID is used as additional authenticated data. The plaintext is
+// the usual packet payload and must only contain lines from that device.
+type PayloadDecryptor struct {
+	keys map[string]cipher.AEAD
+}
+
+const encPrefix = "#enc "
+
+// NewPayloadDecryptor reads "device_id hex_key" pairs from the file, keys are 16, 24 or 32 bytes long.
+func NewPayloadDecryptor(keyFile string) (*PayloadDecryptor, error) {
+	keys, err := readDeviceKeys(keyFile)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	pd := &PayloadDecryptor{keys: make(map[string]cipher.AEAD)}
+	for id, hexKey := range keys {
+		key, err := hex.DecodeString(hexKey)
+		if err != nil {
+			return nil, errors.Errorf("%s: key must be hex-encoded", id)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, errors.Annotatef(err, "%s", id)
+		}
+		if pd.keys[id], err = cipher.NewGCM(block); err != nil {
+			return nil, errors.Annotatef(err, "%s", id)
+		}
+	}
+	return pd, nil
+}
+
+// HasKey returns true if the device has a key and must send encrypted packets.
+func (pd *PayloadDecryptor) HasKey(deviceID string) bool {
+	return pd.keys[deviceID] != nil
+}
+
+// Decrypt decrypts the packet if it is encrypted.
+// Returns the device and the plaintext, or an empty device and the data as is if the packet is not encrypted.
+func (pd *PayloadDecryptor) Decrypt(data []byte) (string, []byte, error) {
+	if !bytes.HasPrefix(data, []byte(encPrefix)) {
+		return "", data, nil
+	}
+	rest := data[len(encPrefix):]
+	i := bytes.IndexByte(rest, ' ')
+	if i <= 0 {
+		return "", nil, errors.Errorf("invalid encrypted packet header")
+	}
+	deviceID, rest := string(rest[:i]), rest[i+1:]
+	aead := pd.keys[deviceID]
+	if aead == nil {
+		return "", nil, errors.Errorf("no key for %s", deviceID)
+	}
+	if len(rest) < aead.NonceSize()+aead.Overhead() {
+		return "", nil, errors.Errorf("encrypted packet is too short")
+	}
+	nonce, ct := rest[:aead.NonceSize()], rest[aead.NonceSize():]
+	plain, err := aead.Open(nil, nonce, ct, []byte(deviceID))
+	if err != nil {
+		return "", nil, errors.Annotatef(err, "%s: decryption failed", deviceID)
+	}
+	return deviceID, plain, nil
+}
@@ -0,0 +1,86 @@
+/*
+ * Copyright (c) 2022 Deomid "rojer" Ryabkov
+ * All rights reserved
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"sync"
+)
+
+// Deduplicator remembers recently seen lines of each device and detects retransmissions.
+// Lines are identified by sequence number and uptime, so lines from after a reboot
+// that reuse sequence numbers are not mistaken for duplicates.
+type Deduplicator struct {
+	window  int
+	mu      sync.Mutex
+	devices map[string]*dedupSet
+}
+
+type dedupKey struct {
+	seq    uint64
+	uptime uint64
+}
+
+type dedupSet struct {
+	seen      map[dedupKey]bool
+	ring      []dedupKey
+	next      int
+	maxSeq    uint64
+	maxUptime uint64
+}
+
+func NewDeduplicator(window int) *Deduplicator {
+	return &Deduplicator{
+		window:  window,
+		devices: make(map[string]*dedupSet),
+	}
+}
+
+// IsDuplicate returns true if the line has already been seen within the window.
+func (dd *Deduplicator) IsDuplicate(li *LineInfo) bool {
+	dd.mu.Lock()
+	defer dd.mu.Unlock()
+	ds := dd.devices[li.DeviceID]
+	if ds == nil {
+		ds = &dedupSet{seen: make(map[dedupKey]bool)}
+		dd.devices[li.DeviceID] = ds
+	}
+	k := dedupKey{seq: li.SeqNum, uptime: li.UptimeMs}
+	if ds.seen[k] {
+		return true
+	}
+	// If the device rebooted, nothing from before is going to match.
+	if isReboot(li, ds.maxSeq, ds.maxUptime, rebootTolerance) {
+		ds.seen = make(map[dedupKey]bool)
+		ds.ring, ds.next, ds.maxSeq, ds.maxUptime = nil, 0, 0, 0
+	}
+	if li.SeqNum > ds.maxSeq {
+		ds.maxSeq = li.SeqNum
+	}
+	if li.UptimeMs > ds.maxUptime {
+		ds.maxUptime = li.UptimeMs
+	}
+	if len(ds.ring) < dd.window {
+		ds.ring = append(ds.ring, k)
+	} else {
+		delete(ds.seen, ds.ring[ds.next])
+		ds.ring[ds.next] = k
+		ds.next = (ds.next + 1) % dd.window
+	}
+	ds.seen[k] = true
+	return false
+}
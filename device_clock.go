@@ -0,0 +1,82 @@
+/*
+ * Copyright (c) 2022 Deomid "rojer" Ryabkov
+ * All rights reserved
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Devices silent for this long are forgotten, their clock starts over with the next line.
+const deviceClockIdleTimeout = time.Hour
+
+// DeviceClock reconstructs the time lines were logged on the device
+// from the time the first line was received and device uptime.
+type DeviceClock struct {
+	mu      sync.Mutex
+	devices map[string]*clockRef
+}
+
+type clockRef struct {
+	receivedAt time.Time
+	uptimeMs   uint64
+	maxSeq     uint64
+	maxUptime  uint64
+	lastSeen   time.Time
+}
+
+func NewDeviceClock() *DeviceClock {
+	dc := &DeviceClock{
+		devices: make(map[string]*clockRef),
+	}
+	go dc.expireLoop()
+	return dc
+}
+
+// Update sets DeviceTime and DeviceTimeStr of the line.
+func (dc *DeviceClock) Update(li *LineInfo) {
+	dc.mu.Lock()
+	ref := dc.devices[li.DeviceID]
+	// Start over if the device rebooted. Late lines keep the reference.
+	if ref == nil || isReboot(li, ref.maxSeq, ref.maxUptime, rebootTolerance) {
+		ref = &clockRef{receivedAt: li.Timestamp, uptimeMs: li.UptimeMs}
+		dc.devices[li.DeviceID] = ref
+	}
+	if li.SeqNum > ref.maxSeq {
+		ref.maxSeq = li.SeqNum
+	}
+	if li.UptimeMs > ref.maxUptime {
+		ref.maxUptime = li.UptimeMs
+	}
+	ref.lastSeen = time.Now()
+	li.DeviceTime = ref.receivedAt.Add(time.Duration(int64(li.UptimeMs)-int64(ref.uptimeMs)) * time.Millisecond)
+	dc.mu.Unlock()
+	li.DeviceTimeStr = FormatTimestamp(li.DeviceTime)
+}
+
+func (dc *DeviceClock) expireLoop() {
+	for now := range time.Tick(deviceClockIdleTimeout / 4) {
+		dc.mu.Lock()
+		for id, ref := range dc.devices {
+			if now.Sub(ref.lastSeen) > deviceClockIdleTimeout {
+				delete(dc.devices, id)
+			}
+		}
+		dc.mu.Unlock()
+	}
+}
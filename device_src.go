@@ -0,0 +1,68 @@
+/*
+ * Copyright (c) 2022 Deomid "rojer" Ryabkov
+ * All rights reserved
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"time"
+
+	klog "k8s.io/klog/v2"
+)
+
+const (
+	// If the device has not been heard from its address for this long, it is assumed to have moved.
+	srcConflictWindow = 10 * time.Minute
+	// Conflict warnings are issued no more often than this.
+	srcConflictWarnInterval = time.Minute
+)
+
+type deviceSrc struct {
+	ip       string
+	lastSeen time.Time
+	lastWarn time.Time
+}
+
+// checkSrcLocked detects different devices reporting under the same ID.
+// With conflictSuffix enabled, returns a copy of the line with the address appended to the device ID
+// if it's from an address other than the one first seen.
+func (fm *FileManager) checkSrcLocked(li *LineInfo) *LineInfo {
+	ip := li.Src.IP.String()
+	now := time.Now()
+	ds := fm.deviceSrcs[li.DeviceIDSafe]
+	switch {
+	case ds == nil:
+		fm.deviceSrcs[li.DeviceIDSafe] = &deviceSrc{ip: ip, lastSeen: now}
+		return li
+	case ds.ip == ip:
+		ds.lastSeen = now
+		return li
+	case now.Sub(ds.lastSeen) > srcConflictWindow:
+		klog.V(1).Infof("Device %s moved from %s to %s", li.DeviceID, ds.ip, ip)
+		ds.ip, ds.lastSeen = ip, now
+		return li
+	}
+	if now.Sub(ds.lastWarn) > srcConflictWarnInterval {
+		klog.Warningf("Device %s: got lines from %s, but it is also active at %s. Duplicate device ID?", li.DeviceID, ip, ds.ip)
+		ds.lastWarn = now
+	}
+	if !fm.conflictSuffix {
+		return li
+	}
+	lic := *li
+	lic.DeviceIDSafe = li.DeviceIDSafe + "_" + sanitize(ip)
+	return &lic
+}
@@ -0,0 +1,103 @@
+/*
+ * Copyright (c) 2022 Deomid "rojer" Ryabkov
+ * All rights reserved
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"net"
+	"regexp"
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/rojer/mos_udp_log_catcher/logline"
+)
+
+// parserRule selects the parser for lines from a subnet or for a device.
+type parserRule struct {
+	subnet *net.IPNet
+	device *regexp.Regexp
+	parser logline.Parser
+}
+
+var parserRules []*parserRule // Set by --device-parser.
+
+// newParserRules parses --device-parser entries, "selector=parser".
+// Selector is an IP address, a subnet in CIDR notation or a device ID glob pattern.
+func newParserRules(specs []string) ([]*parserRule, error) {
+	var res []*parserRule
+	for _, spec := range specs {
+		i := strings.LastIndexByte(spec, '=')
+		if i <= 0 {
+			return nil, errors.Errorf("invalid parser rule %q, expected selector=parser", spec)
+		}
+		sel, name := spec[:i], spec[i+1:]
+		r := &parserRule{}
+		var ok bool
+		if r.parser, ok = logline.LookupParser(name); !ok {
+			return nil, errors.Errorf("invalid parser %q in rule %q, must be one of: %s", name, spec, strings.Join(logline.ParserNames(), ", "))
+		}
+		if _, subnet, err := net.ParseCIDR(sel); err == nil {
+			r.subnet = subnet
+		} else if ip := net.ParseIP(sel); ip != nil {
+			bits := 8 * len(ip.To16())
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			r.subnet = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		} else {
+			if r.device, err = compileGlob(sel); err != nil {
+				return nil, errors.Annotatef(err, "invalid device pattern in rule %q", spec)
+			}
+		}
+		res = append(res, r)
+	}
+	return res, nil
+}
+
+// parserFor returns the parser for data from src: that of the first matching subnet rule or the global one.
+func parserFor(src *net.UDPAddr) logline.Parser {
+	for _, r := range parserRules {
+		if r.subnet != nil && r.subnet.Contains(src.IP) {
+			return r.parser
+		}
+	}
+	return inputParser
+}
+
+// parseWithRules parses the line with the parser selected for it.
+// Device rules are tried first: the line is parsed with the rule's parser and
+// the result is used if it succeeds and the device ID matches.
+// Lines without device ID are matched by the source address.
+func parseWithRules(src *net.UDPAddr, line []byte) (*logline.LineInfo, error) {
+	for _, r := range parserRules {
+		if r.device == nil {
+			continue
+		}
+		pli, err := r.parser.Parse(line)
+		if err != nil {
+			continue
+		}
+		id := pli.DeviceID
+		if id == "" {
+			id = src.IP.String()
+		}
+		if r.device.MatchString(id) {
+			return pli, nil
+		}
+	}
+	return parserFor(src).Parse(line)
+}
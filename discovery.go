@@ -0,0 +1,95 @@
+/*
+ * Copyright (c) 2022 Deomid "rojer" Ryabkov
+ * All rights reserved
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/juju/errors"
+	klog "k8s.io/klog/v2"
+)
+
+// discoveryResponder answers "where is the log catcher?" probes broadcast by devices,
+// so they can configure their log destination automatically.
+type discoveryResponder struct {
+	c     *net.UDPConn
+	probe []byte
+	reply string
+	port  int // UDP log port used in the default reply.
+}
+
+// newDiscoveryResponder listens for probes on the port. If reply is empty,
+// the reply is udp://ip:logPort/ with the local address facing the device.
+func newDiscoveryResponder(port int, probe, reply string, logPort int) (*discoveryResponder, error) {
+	if reply == "" && logPort == 0 {
+		return nil, errors.Errorf("no UDP listener to announce, --discovery-reply is required")
+	}
+	c, err := net.ListenUDP("udp", &net.UDPAddr{Port: port})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	klog.Infof("Answering discovery probes on UDP port %d...", port)
+	return &discoveryResponder{c: c, probe: []byte(probe), reply: reply, port: logPort}, nil
+}
+
+func (dr *discoveryResponder) Run(wp *WorkerPool) error {
+	buf := make([]byte, 1500)
+	var lastErr time.Time
+	for {
+		n, src, err := dr.c.ReadFromUDP(buf)
+		if err != nil {
+			return errors.Annotatef(err, "discovery socket read error")
+		}
+		if !bytes.Equal(bytes.TrimSpace(buf[:n]), dr.probe) {
+			continue
+		}
+		reply := dr.reply
+		if reply == "" {
+			ip, err := localIPFor(src)
+			if err != nil {
+				if time.Since(lastErr) > 10*time.Second {
+					klog.Errorf("Discovery: no route to %s: %v", src, err)
+					lastErr = time.Now()
+				}
+				continue
+			}
+			reply = fmt.Sprintf("udp://%s/", net.JoinHostPort(ip.String(), strconv.Itoa(dr.port)))
+		}
+		klog.V(1).Infof("Discovery: %s -> %s", src, reply)
+		dr.c.WriteToUDP([]byte(reply), src)
+	}
+}
+
+func (dr *discoveryResponder) Close() error {
+	return dr.c.Close()
+}
+
+// localIPFor returns the local address that would be used to send packets to the destination.
+func localIPFor(dst *net.UDPAddr) (net.IP, error) {
+	// Connecting a UDP socket does not send anything, it only selects the route.
+	c, err := net.DialUDP("udp", nil, dst)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	return c.LocalAddr().(*net.UDPAddr).IP, nil
+}
@@ -0,0 +1,657 @@
+/*
+ * Copyright (c) 2022 Deomid "rojer" Ryabkov
+ * All rights reserved
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/juju/errors"
+	klog "k8s.io/klog/v2"
+)
+
+// Minimal DTLS 1.2 (RFC 6347) server for dtls:// listeners.
+// Devices authenticate with pre-shared keys (RFC 4279) and the only cipher suite is
+// TLS_PSK_WITH_AES_128_GCM_SHA256 (RFC 5487), which is what small devices usually support.
+// Each application data record carries one or more log lines.
+// The server only ever sends a flight in response to one from the client, so when
+// a server flight is lost, it is sent again when the client retransmits its own.
+
+const (
+	dtlsVersion            = 0xfefd // DTLS 1.2.
+	dtlsPSKWithAES128GCM   = 0x00a8
+	dtlsRenegInfoSCSV      = 0x00ff
+	dtlsExtRenegInfo       = 0xff01
+	dtlsRecordHeaderLen    = 13
+	dtlsHandshakeHeaderLen = 12
+	dtlsExplicitNonceLen   = 8
+	dtlsVerifyDataLen      = 12
+	// Idle sessions are forgotten after this long, the device has to handshake again.
+	dtlsSessionTimeout = time.Hour
+)
+
+// Record content types.
+const (
+	dtlsChangeCipherSpec = 20
+	dtlsAlert            = 21
+	dtlsHandshake        = 22
+	dtlsApplicationData  = 23
+)
+
+// Handshake message types.
+const (
+	dtlsClientHello        = 1
+	dtlsServerHello        = 2
+	dtlsHelloVerifyRequest = 3
+	dtlsServerHelloDone    = 14
+	dtlsClientKeyExchange  = 16
+	dtlsFinished           = 20
+)
+
+// Alert descriptions.
+const (
+	dtlsAlertCloseNotify        = 0
+	dtlsAlertUnexpectedMessage  = 10
+	dtlsAlertBadRecordMAC       = 20
+	dtlsAlertHandshakeFailure   = 40
+	dtlsAlertDecodeError        = 50
+	dtlsAlertDecryptError       = 51
+	dtlsAlertProtocolVersion    = 70
+	dtlsAlertUnknownPSKIdentity = 115
+)
+
+// dtlsError is a handshake failure reported to the client with a fatal alert.
+type dtlsError struct {
+	alert byte
+	msg   string
+}
+
+func (e *dtlsError) Error() string {
+	return e.msg
+}
+
+func dtlsErrorf(alert byte, format string, args ...interface{}) error {
+	return &dtlsError{alert: alert, msg: fmt.Sprintf(format, args...)}
+}
+
+// dtlsPeer is the state of a client: handshake in progress or an established session.
+type dtlsPeer struct {
+	lastSeen     time.Time
+	clientRandom []byte
+	serverRandom []byte
+	renegInfo    bool   // Client supports secure renegotiation, must be acknowledged.
+	transcript   []byte // Handshake messages so far, for Finished.
+	recvMsgSeq   uint16 // Next handshake message expected from the client.
+	sendMsgSeq   uint16
+	sendEpoch    uint16
+	sendSeq      uint64
+	identity     string
+	master       []byte
+	readEpoch    uint16 // Becomes 1 after the client's ChangeCipherSpec.
+	readCipher   cipher.AEAD
+	readIV       []byte
+	writeCipher  cipher.AEAD
+	writeIV      []byte
+	replayMax    uint64 // Highest sequence number received in epoch 1.
+	replayMask   uint64 // Bit n is set if replayMax-n has been received.
+	established  bool
+	lastFlight   []byte // Sent again if the client retransmits.
+}
+
+type dtlsInput struct {
+	c         *net.UDPConn
+	tag       string
+	keys      map[string][]byte // By PSK identity.
+	cookieKey []byte
+	peers     map[string]*dtlsPeer
+	lastSweep time.Time
+}
+
+// listenDTLS opens a DTLS listener, pskFile contains "identity hex_key" pairs.
+func listenDTLS(network, hostPort, tag, pskFile string) (*dtlsInput, error) {
+	if pskFile == "" {
+		return nil, errors.Errorf("--dtls-psk-file is required for dtls://")
+	}
+	hexKeys, err := readDeviceKeys(pskFile)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	in := &dtlsInput{
+		tag:       tag,
+		keys:      make(map[string][]byte),
+		cookieKey: make([]byte, 32),
+		peers:     make(map[string]*dtlsPeer),
+	}
+	for id, hexKey := range hexKeys {
+		if in.keys[id], err = hex.DecodeString(hexKey); err != nil || len(in.keys[id]) == 0 {
+			return nil, errors.Errorf("%s: key must be hex-encoded", id)
+		}
+	}
+	if _, err := rand.Read(in.cookieKey); err != nil {
+		return nil, errors.Trace(err)
+	}
+	addr, err := net.ResolveUDPAddr(network, hostPort)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if in.c, err = net.ListenUDP(network, addr); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err := setRcvBuf(in.c); err != nil {
+		in.c.Close()
+		return nil, errors.Trace(err)
+	}
+	klog.Infof("Listening for DTLS on %s...", in.c.LocalAddr())
+	return in, nil
+}
+
+func (in *dtlsInput) Run(wp *WorkerPool) error {
+	buf := make([]byte, 65536)
+	for {
+		n, src, err := in.c.ReadFromUDP(buf)
+		if err != nil {
+			return errors.Annotatef(err, "socket read error")
+		}
+		rxPackets.Add(1)
+		rxBytes.Add(int64(n))
+		now := time.Now()
+		in.sweep(now)
+		for _, data := range in.handle(now, src, buf[:n]) {
+			if !wp.Enqueue(&packet{ts: now, src: src, data: data, listener: in.tag}) {
+				droppedPackets.Add(1)
+				klog.V(1).Infof("Queue full, dropped packet from %s", src)
+			}
+		}
+	}
+}
+
+func (in *dtlsInput) Close() error {
+	return in.c.Close()
+}
+
+func (in *dtlsInput) sweep(now time.Time) {
+	if now.Sub(in.lastSweep) < dtlsSessionTimeout/4 {
+		return
+	}
+	for k, p := range in.peers {
+		if now.Sub(p.lastSeen) > dtlsSessionTimeout {
+			delete(in.peers, k)
+		}
+	}
+	in.lastSweep = now
+}
+
+// handle processes the records of a datagram and returns decrypted application data.
+func (in *dtlsInput) handle(now time.Time, src *net.UDPAddr, data []byte) [][]byte {
+	var res [][]byte
+	key := src.String()
+	peer := in.peers[key]
+	resend := false
+	for len(data) >= dtlsRecordHeaderLen {
+		typ := data[0]
+		epoch := binary.BigEndian.Uint16(data[3:5])
+		seq := dtlsUint48(data[5:11])
+		length := int(binary.BigEndian.Uint16(data[11:13]))
+		if len(data) < dtlsRecordHeaderLen+length {
+			break
+		}
+		hdr, body := data[:dtlsRecordHeaderLen], data[dtlsRecordHeaderLen:dtlsRecordHeaderLen+length]
+		data = data[dtlsRecordHeaderLen+length:]
+		if epoch == 0 && typ == dtlsHandshake && len(body) > 0 && body[0] == dtlsClientHello {
+			np, err := in.clientHello(src, seq, body, peer)
+			if err != nil {
+				klog.V(1).Infof("DTLS %s: %v", src, err)
+				if de, ok := err.(*dtlsError); ok {
+					in.c.WriteToUDP(dtlsRecord(dtlsAlert, 0, seq, []byte{2, de.alert}), src)
+				}
+				continue
+			}
+			if np != nil {
+				np.lastSeen = now
+				peer = np
+				in.peers[key] = peer
+			}
+			continue
+		}
+		if peer == nil {
+			continue
+		}
+		if epoch != peer.readEpoch {
+			// The client retransmitted its last flight, our Finished was lost.
+			if epoch == 0 && typ == dtlsHandshake && peer.established {
+				resend = true
+			}
+			continue
+		}
+		if epoch > 0 {
+			if peer.replayed(seq) {
+				continue
+			}
+			var err error
+			if body, err = peer.decrypt(hdr, body); err != nil {
+				if !peer.established {
+					// The first encrypted record is Finished, the client must be using a different key.
+					klog.Errorf("DTLS %s: handshake failed: wrong key for %q", src, peer.identity)
+					in.c.WriteToUDP(peer.record(dtlsAlert, []byte{2, dtlsAlertBadRecordMAC}), src)
+					delete(in.peers, key)
+					peer = nil
+				}
+				// Otherwise records that fail authentication are silently discarded (RFC 6347, 4.1.2.7).
+				continue
+			}
+			peer.markSeen(seq)
+		}
+		peer.lastSeen = now
+		switch typ {
+		case dtlsChangeCipherSpec:
+			if peer.readCipher != nil && len(body) == 1 && body[0] == 1 {
+				peer.readEpoch = 1
+			}
+		case dtlsAlert:
+			if len(body) == 2 && (body[0] == 2 || body[1] == dtlsAlertCloseNotify) {
+				klog.V(1).Infof("DTLS %s: session closed by the client, alert %d", src, body[1])
+				delete(in.peers, key)
+				peer = nil
+			}
+		case dtlsHandshake:
+			rs, err := in.handshake(src, peer, epoch, body)
+			if err != nil {
+				klog.Errorf("DTLS %s: handshake failed: %v", src, err)
+				if de, ok := err.(*dtlsError); ok {
+					in.c.WriteToUDP(peer.record(dtlsAlert, []byte{2, de.alert}), src)
+				}
+				delete(in.peers, key)
+				peer = nil
+			}
+			resend = resend || rs
+		case dtlsApplicationData:
+			if peer.established && len(body) > 0 {
+				res = append(res, body)
+			}
+		}
+	}
+	if resend && peer != nil && peer.lastFlight != nil {
+		in.c.WriteToUDP(peer.lastFlight, src)
+	}
+	return res
+}
+
+// clientHello responds to a ClientHello with HelloVerifyRequest if the cookie is missing or invalid,
+// otherwise starts a new handshake and returns the new peer.
+func (in *dtlsInput) clientHello(src *net.UDPAddr, recSeq uint64, msg []byte, peer *dtlsPeer) (*dtlsPeer, error) {
+	if len(msg) < dtlsHandshakeHeaderLen {
+		return nil, errors.Errorf("invalid ClientHello")
+	}
+	length, msgSeq := dtlsUint24(msg[1:4]), binary.BigEndian.Uint16(msg[4:6])
+	if dtlsUint24(msg[6:9]) != 0 || dtlsUint24(msg[9:12]) != length || len(msg) != dtlsHandshakeHeaderLen+length {
+		return nil, errors.Errorf("fragmented ClientHello is not supported")
+	}
+	r := dtlsReader(msg[dtlsHandshakeHeaderLen:])
+	version := r.uint16()
+	random := r.bytes(32)
+	r.vector(1) // Session ID.
+	cookie := r.vector(1)
+	suites := r.vector(2)
+	r.vector(1) // Compression methods.
+	var exts []byte
+	if len(r) > 0 {
+		exts = r.vector(2)
+	}
+	if r == nil {
+		return nil, dtlsErrorf(dtlsAlertDecodeError, "invalid ClientHello")
+	}
+	// DTLS version numbers go down.
+	if version > dtlsVersion {
+		return nil, dtlsErrorf(dtlsAlertProtocolVersion, "unsupported version %#x", version)
+	}
+	expCookie := in.cookie(src, random)
+	if !hmac.Equal(cookie, expCookie) {
+		hvr := []byte{dtlsVersion >> 8, dtlsVersion & 0xff, byte(len(expCookie))}
+		hvr = append(hvr, expCookie...)
+		hs := dtlsHandshakeMsg(dtlsHelloVerifyRequest, msgSeq, hvr)
+		// The server is stateless at this point, the record sequence number is taken from the ClientHello.
+		in.c.WriteToUDP(dtlsRecord(dtlsHandshake, 0, recSeq, hs), src)
+		return nil, nil
+	}
+	if peer != nil && bytes.Equal(peer.clientRandom, random) {
+		// Retransmission, our response was lost.
+		if !peer.established {
+			in.c.WriteToUDP(peer.lastFlight, src)
+		}
+		return nil, nil
+	}
+	np := &dtlsPeer{
+		clientRandom: append([]byte(nil), random...),
+		serverRandom: make([]byte, 32),
+		transcript:   append([]byte(nil), msg...),
+		recvMsgSeq:   msgSeq + 1,
+		sendMsgSeq:   msgSeq,
+		sendSeq:      recSeq,
+	}
+	supported := false
+	for sr := dtlsReader(suites); len(sr) >= 2; {
+		switch sr.uint16() {
+		case dtlsPSKWithAES128GCM:
+			supported = true
+		case dtlsRenegInfoSCSV:
+			np.renegInfo = true
+		}
+	}
+	for er := dtlsReader(exts); len(er) >= 4; {
+		typ := er.uint16()
+		er.vector(2)
+		if typ == dtlsExtRenegInfo {
+			np.renegInfo = true
+		}
+	}
+	if !supported {
+		return nil, dtlsErrorf(dtlsAlertHandshakeFailure, "no supported cipher suites")
+	}
+	if _, err := rand.Read(np.serverRandom); err != nil {
+		return nil, errors.Trace(err)
+	}
+	sh := []byte{dtlsVersion >> 8, dtlsVersion & 0xff}
+	sh = append(sh, np.serverRandom...)
+	sh = append(sh, 0) // No session ID, sessions are not resumed.
+	sh = append(sh, dtlsPSKWithAES128GCM>>8, dtlsPSKWithAES128GCM&0xff, 0)
+	if np.renegInfo {
+		// Empty renegotiation_info, renegotiation is not supported anyway.
+		sh = append(sh, 0, 5, dtlsExtRenegInfo>>8, dtlsExtRenegInfo&0xff, 0, 1, 0)
+	}
+	flight := np.record(dtlsHandshake, np.handshakeMsg(dtlsServerHello, sh))
+	flight = append(flight, np.record(dtlsHandshake, np.handshakeMsg(dtlsServerHelloDone, nil))...)
+	np.lastFlight = flight
+	in.c.WriteToUDP(flight, src)
+	return np, nil
+}
+
+// handshake processes handshake messages received after ClientHello.
+// Returns true if the client retransmitted messages we have already processed.
+func (in *dtlsInput) handshake(src *net.UDPAddr, peer *dtlsPeer, epoch uint16, data []byte) (bool, error) {
+	resend := false
+	for len(data) > 0 {
+		if len(data) < dtlsHandshakeHeaderLen {
+			return false, dtlsErrorf(dtlsAlertDecodeError, "invalid handshake message")
+		}
+		length, msgSeq := dtlsUint24(data[1:4]), binary.BigEndian.Uint16(data[4:6])
+		fragOff, fragLen := dtlsUint24(data[6:9]), dtlsUint24(data[9:12])
+		if len(data) < dtlsHandshakeHeaderLen+fragLen {
+			return false, dtlsErrorf(dtlsAlertDecodeError, "invalid handshake message")
+		}
+		msg := data[:dtlsHandshakeHeaderLen+fragLen]
+		data = data[len(msg):]
+		if msgSeq < peer.recvMsgSeq {
+			resend = true
+			continue
+		}
+		if msgSeq > peer.recvMsgSeq {
+			// Previous message was lost, the client will retransmit.
+			continue
+		}
+		if fragOff != 0 || fragLen != length {
+			return false, dtlsErrorf(dtlsAlertHandshakeFailure, "fragmented handshake messages are not supported")
+		}
+		peer.recvMsgSeq++
+		var err error
+		switch {
+		case msg[0] == dtlsClientKeyExchange && peer.master == nil:
+			err = in.clientKeyExchange(peer, msg)
+		case msg[0] == dtlsFinished && epoch == 1 && !peer.established:
+			err = in.finished(src, peer, msg)
+		default:
+			err = dtlsErrorf(dtlsAlertUnexpectedMessage, "unexpected handshake message %d", msg[0])
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+	return resend, nil
+}
+
+func (in *dtlsInput) clientKeyExchange(peer *dtlsPeer, msg []byte) error {
+	r := dtlsReader(msg[dtlsHandshakeHeaderLen:])
+	identity := string(r.vector(2))
+	if r == nil {
+		return dtlsErrorf(dtlsAlertDecodeError, "invalid ClientKeyExchange")
+	}
+	psk := in.keys[identity]
+	if psk == nil {
+		return dtlsErrorf(dtlsAlertUnknownPSKIdentity, "unknown PSK identity %q", identity)
+	}
+	peer.identity = identity
+	peer.transcript = append(peer.transcript, msg...)
+	// Premaster secret for plain PSK: zeros of the same length as the key, then the key (RFC 4279, 2).
+	pms := make([]byte, 2+len(psk)+2, 2+len(psk)+2+len(psk))
+	binary.BigEndian.PutUint16(pms, uint16(len(psk)))
+	binary.BigEndian.PutUint16(pms[2+len(psk):], uint16(len(psk)))
+	pms = append(pms, psk...)
+	peer.master = dtlsPRF(pms, "master secret", append(peer.clientRandom, peer.serverRandom...), 48)
+	kb := dtlsPRF(peer.master, "key expansion", append(peer.serverRandom, peer.clientRandom...), 2*16+2*4)
+	var err error
+	if peer.readCipher, err = newAESGCM(kb[0:16]); err != nil {
+		return errors.Trace(err)
+	}
+	if peer.writeCipher, err = newAESGCM(kb[16:32]); err != nil {
+		return errors.Trace(err)
+	}
+	peer.readIV, peer.writeIV = kb[32:36], kb[36:40]
+	return nil
+}
+
+func (in *dtlsInput) finished(src *net.UDPAddr, peer *dtlsPeer, msg []byte) error {
+	th := sha256.Sum256(peer.transcript)
+	exp := dtlsPRF(peer.master, "client finished", th[:], dtlsVerifyDataLen)
+	if !hmac.Equal(msg[dtlsHandshakeHeaderLen:], exp) {
+		return dtlsErrorf(dtlsAlertDecryptError, "invalid Finished from %q", peer.identity)
+	}
+	peer.transcript = append(peer.transcript, msg...)
+	th = sha256.Sum256(peer.transcript)
+	flight := peer.record(dtlsChangeCipherSpec, []byte{1})
+	peer.sendEpoch, peer.sendSeq = 1, 0
+	fin := peer.handshakeMsg(dtlsFinished, dtlsPRF(peer.master, "server finished", th[:], dtlsVerifyDataLen))
+	flight = append(flight, peer.record(dtlsHandshake, fin)...)
+	peer.lastFlight = flight
+	// Not needed anymore.
+	peer.transcript = nil
+	peer.established = true
+	in.c.WriteToUDP(flight, src)
+	klog.Infof("DTLS %s: session established with %q", src, peer.identity)
+	return nil
+}
+
+// cookie is bound to the client's address and random, so the cookie exchange proves
+// that the client can receive packets at the address.
+func (in *dtlsInput) cookie(src *net.UDPAddr, random []byte) []byte {
+	mac := hmac.New(sha256.New, in.cookieKey)
+	mac.Write([]byte(src.String()))
+	mac.Write(random)
+	return mac.Sum(nil)[:16]
+}
+
+// handshakeMsg builds an unfragmented handshake message and adds it to the transcript.
+func (p *dtlsPeer) handshakeMsg(typ byte, body []byte) []byte {
+	m := dtlsHandshakeMsg(typ, p.sendMsgSeq, body)
+	p.sendMsgSeq++
+	p.transcript = append(p.transcript, m...)
+	return m
+}
+
+// record builds a record in the current sending epoch, encrypted if the epoch is not 0.
+func (p *dtlsPeer) record(typ byte, payload []byte) []byte {
+	seq := p.sendSeq
+	p.sendSeq++
+	if p.sendEpoch == 0 {
+		return dtlsRecord(typ, 0, seq, payload)
+	}
+	rec := dtlsRecord(typ, p.sendEpoch, seq, nil)
+	explicitNonce := rec[3:11]
+	nonce := append(append([]byte(nil), p.writeIV...), explicitNonce...)
+	out := append([]byte(nil), explicitNonce...)
+	out = p.writeCipher.Seal(out, nonce, payload, dtlsAAD(rec[:dtlsRecordHeaderLen], len(payload)))
+	binary.BigEndian.PutUint16(rec[11:13], uint16(len(out)))
+	return append(rec, out...)
+}
+
+func (p *dtlsPeer) decrypt(hdr, body []byte) ([]byte, error) {
+	if len(body) < dtlsExplicitNonceLen+p.readCipher.Overhead() {
+		return nil, errors.Errorf("record is too short")
+	}
+	nonce := append(append([]byte(nil), p.readIV...), body[:dtlsExplicitNonceLen]...)
+	plainLen := len(body) - dtlsExplicitNonceLen - p.readCipher.Overhead()
+	return p.readCipher.Open(nil, nonce, body[dtlsExplicitNonceLen:], dtlsAAD(hdr, plainLen))
+}
+
+// replayed returns true if a record with this sequence number has been received already
+// or is too old to tell.
+func (p *dtlsPeer) replayed(seq uint64) bool {
+	if seq > p.replayMax {
+		return false
+	}
+	d := p.replayMax - seq
+	return d >= 64 || p.replayMask&(1<<d) != 0
+}
+
+func (p *dtlsPeer) markSeen(seq uint64) {
+	if seq > p.replayMax {
+		if d := seq - p.replayMax; d < 64 {
+			p.replayMask <<= d
+		} else {
+			p.replayMask = 0
+		}
+		p.replayMax = seq
+	}
+	p.replayMask |= 1 << (p.replayMax - seq)
+}
+
+func dtlsRecord(typ byte, epoch uint16, seq uint64, payload []byte) []byte {
+	rec := make([]byte, dtlsRecordHeaderLen, dtlsRecordHeaderLen+len(payload))
+	rec[0] = typ
+	binary.BigEndian.PutUint16(rec[1:3], dtlsVersion)
+	binary.BigEndian.PutUint16(rec[3:5], epoch)
+	putDTLSUint48(rec[5:11], seq)
+	binary.BigEndian.PutUint16(rec[11:13], uint16(len(payload)))
+	return append(rec, payload...)
+}
+
+func dtlsHandshakeMsg(typ byte, msgSeq uint16, body []byte) []byte {
+	m := make([]byte, dtlsHandshakeHeaderLen, dtlsHandshakeHeaderLen+len(body))
+	m[0] = typ
+	putDTLSUint24(m[1:4], len(body))
+	binary.BigEndian.PutUint16(m[4:6], msgSeq)
+	putDTLSUint24(m[9:12], len(body))
+	return append(m, body...)
+}
+
+// dtlsAAD is the additional data of an AEAD record: epoch and sequence number, type, version and plaintext length.
+func dtlsAAD(hdr []byte, plainLen int) []byte {
+	aad := make([]byte, 13)
+	copy(aad, hdr[3:11])
+	aad[8] = hdr[0]
+	copy(aad[9:11], hdr[1:3])
+	binary.BigEndian.PutUint16(aad[11:13], uint16(plainLen))
+	return aad
+}
+
+// dtlsPRF is the TLS 1.2 PRF with SHA-256 (RFC 5246, 5).
+func dtlsPRF(secret []byte, label string, seed []byte, n int) []byte {
+	seed = append([]byte(label), seed...)
+	var res []byte
+	a := seed
+	for len(res) < n {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(a)
+		a = mac.Sum(nil)
+		mac = hmac.New(sha256.New, secret)
+		mac.Write(a)
+		mac.Write(seed)
+		res = mac.Sum(res)
+	}
+	return res[:n]
+}
+
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func dtlsUint24(b []byte) int {
+	return int(b[0])<<16 | int(b[1])<<8 | int(b[2])
+}
+
+func putDTLSUint24(b []byte, v int) {
+	b[0], b[1], b[2] = byte(v>>16), byte(v>>8), byte(v)
+}
+
+func dtlsUint48(b []byte) uint64 {
+	return uint64(binary.BigEndian.Uint16(b))<<32 | uint64(binary.BigEndian.Uint32(b[2:]))
+}
+
+func putDTLSUint48(b []byte, v uint64) {
+	binary.BigEndian.PutUint16(b, uint16(v>>32))
+	binary.BigEndian.PutUint32(b[2:], uint32(v))
+}
+
+// dtlsReader decodes handshake message fields. It becomes nil if the data is truncated,
+// after that all reads return zero values.
+type dtlsReader []byte
+
+func (r *dtlsReader) bytes(n int) []byte {
+	if len(*r) < n {
+		*r = nil
+		return nil
+	}
+	b := (*r)[:n]
+	*r = (*r)[n:]
+	return b
+}
+
+func (r *dtlsReader) uint16() uint16 {
+	b := r.bytes(2)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint16(b)
+}
+
+// vector reads a variable-length field with a length prefix of lenSize bytes.
+func (r *dtlsReader) vector(lenSize int) []byte {
+	lb := r.bytes(lenSize)
+	if lb == nil {
+		return nil
+	}
+	n := 0
+	for _, b := range lb {
+		n = n<<8 | int(b)
+	}
+	if b := r.bytes(n); b != nil {
+		return b
+	}
+	return []byte{}
+}
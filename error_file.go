@@ -0,0 +1,119 @@
+/*
+ * Copyright (c) 2022 Deomid "rojer" Ryabkov
+ * All rights reserved
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	klog "k8s.io/klog/v2"
+)
+
+// ErrorFile records lines that could not be parsed, for later analysis.
+// Each record contains time, source address, reason and the raw line, quoted.
+// At most rate records per second are written, the rest are counted and discarded.
+// In quarantine mode, records go to a new file in the directory every day and
+// the raw data is hex-dumped.
+type ErrorFile struct {
+	fd          *os.File
+	dir         string // Quarantine directory.
+	day         string // Date of the currently open quarantine file, YYYYMMDD.
+	mode        os.FileMode
+	rate        int
+	mu          sync.Mutex
+	second      time.Time
+	numWritten  int
+	numRejected int
+}
+
+func NewErrorFile(fname string, rate int, mode os.FileMode) (*ErrorFile, error) {
+	fd, err := os.OpenFile(fname, os.O_APPEND|os.O_CREATE|os.O_WRONLY, mode)
+	if err != nil {
+		return nil, errors.Annotatef(err, "failed to open error file")
+	}
+	return &ErrorFile{fd: fd, rate: rate}, nil
+}
+
+// NewQuarantineDir returns an error file that writes to quarantine-YYYYMMDD.log files in dir.
+func NewQuarantineDir(dir string, rate int, mode, dirMode os.FileMode) (*ErrorFile, error) {
+	if err := os.MkdirAll(dir, dirMode); err != nil {
+		return nil, errors.Annotatef(err, "failed to create quarantine directory")
+	}
+	return &ErrorFile{dir: dir, mode: mode, rate: rate}, nil
+}
+
+// openDayLocked makes sure the quarantine file for the day of ts is open.
+func (ef *ErrorFile) openDayLocked(ts time.Time) error {
+	day := ts.Format("20060102")
+	if ef.fd != nil && day == ef.day {
+		return nil
+	}
+	fd, err := os.OpenFile(filepath.Join(ef.dir, "quarantine-"+day+".log"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, ef.mode)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if ef.fd != nil {
+		ef.fd.Close()
+	}
+	ef.fd, ef.day = fd, day
+	return nil
+}
+
+func (ef *ErrorFile) Write(ts time.Time, src *net.UDPAddr, line []byte, reason string, perr error) {
+	ef.mu.Lock()
+	defer ef.mu.Unlock()
+	if sec := ts.Truncate(time.Second); !sec.Equal(ef.second) {
+		if ef.numRejected > 0 {
+			klog.Warningf("Error file rate limit exceeded, %d lines not recorded", ef.numRejected)
+		}
+		ef.second, ef.numWritten, ef.numRejected = sec, 0, 0
+	}
+	if ef.rate > 0 && ef.numWritten >= ef.rate {
+		ef.numRejected++
+		rejectedErrorLines.Add(1)
+		return
+	}
+	ef.numWritten++
+	var err error
+	// Written unbuffered, these are expected to be rare.
+	if ef.dir == "" {
+		_, err = fmt.Fprintf(ef.fd, "%s %s %s: %v %q\n", ts.Format(time.RFC3339Nano), src, reason, perr, line)
+	} else if err = ef.openDayLocked(ts); err == nil {
+		_, err = fmt.Fprintf(ef.fd, "%s %s %s: %v (%d bytes)\n%s\n", ts.Format(time.RFC3339Nano), src, reason, perr, len(line), hex.Dump(line))
+	}
+	if err != nil {
+		klog.Errorf("Failed to write to error file: %v", err)
+		return
+	}
+	quarantinedLines.Add(1)
+}
+
+func (ef *ErrorFile) Close() error {
+	ef.mu.Lock()
+	defer ef.mu.Unlock()
+	if ef.fd == nil {
+		return nil
+	}
+	return ef.fd.Close()
+}
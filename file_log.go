@@ -18,29 +18,45 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"net"
 	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
 	"sync"
 	"text/template"
 	"time"
 
 	"github.com/juju/errors"
+	"github.com/rojer/mos_udp_log_catcher/logline"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/encoding/unicode"
 	klog "k8s.io/klog/v2"
 )
 
+// Default file name templates, relative to the log dir.
 const (
-	deviceLogName       = "{{.DeviceIDSafe}}.{{.Year}}{{.Month}}{{.Day}}.log"
-	latestDeviceLogName = "{{.DeviceIDSafe}}.log"
+	deviceLogName         = "{{.DeviceIDSafe}}/{{.DeviceIDSafe}}.{{.Year}}{{.Month}}{{.Day}}.log"
+	latestDeviceLogName   = "{{.DeviceIDSafe}}/{{.DeviceIDSafe}}.log"
+	deviceFDLogName       = "{{.DeviceIDSafe}}/{{.DeviceIDSafe}}.{{.FDName}}.{{.Year}}{{.Month}}{{.Day}}.log"
+	latestDeviceFDLogName = "{{.DeviceIDSafe}}/{{.DeviceIDSafe}}.{{.FDName}}.log"
 )
 
 type deviceInfo struct {
 	fd       *os.File
+	w        *bufio.Writer
 	fname    string
 	lastUsed time.Time
+	fileMode os.FileMode
+	dirMode  os.FileMode
+	fsync    bool
 }
 
-func (di *deviceInfo) Open(nameTmpl, latestNameTmpl *template.Template, li *LineInfo) error {
+func (di *deviceInfo) Open(nameTmpl *template.Template, latestName string, li *LineInfo) error {
 	fname, err := execTmpl(nameTmpl, li)
 	if err != nil {
 		return errors.Annotatef(err, "Failed to execute file name template: %v", err)
@@ -52,50 +68,88 @@ func (di *deviceInfo) Open(nameTmpl, latestNameTmpl *template.Template, li *Line
 		di.Close()
 	}
 	di.fname = fname
-	if err := os.MkdirAll(filepath.Dir(fname), 0o755); err != nil {
+	if err := os.MkdirAll(filepath.Dir(fname), di.dirMode); err != nil {
 		return errors.Annotatef(err, "failed to create log dir")
 	}
-	if fd, err := os.OpenFile(di.fname, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644); err != nil {
+	if fd, err := os.OpenFile(di.fname, os.O_APPEND|os.O_CREATE|os.O_WRONLY, di.fileMode); err != nil {
 		return errors.Trace(err)
 	} else {
 		klog.Infof("Opened %s", di.fname)
 		di.fd = fd
+		di.w = bufio.NewWriter(fd)
 	}
-	if latestNameTmpl != nil {
-		latestName, err := execTmpl(latestNameTmpl, li)
-		if err != nil {
-			return errors.Annotatef(err, "Failed to execute file name template: %v", err)
-		}
+	if latestName != "" {
 		target, err := os.Readlink(latestName)
-		latestBase := filepath.Base(di.fname)
-		if err != nil || target != latestBase {
+		latestTarget, _ := filepath.Rel(filepath.Dir(latestName), di.fname)
+		if err != nil || target != latestTarget {
+			// Never remove a real file, it may be someone's log.
+			if st, err := os.Lstat(latestName); err == nil && st.Mode()&os.ModeSymlink == 0 {
+				klog.Errorf("%s exists and is not a symlink, not updating", latestName)
+				return nil
+			}
 			os.Remove(latestName)
-			if err = os.Symlink(latestBase, latestName); err != nil {
-				klog.Errorf("Failed to symlink %s to %s", di.fname, latestBase)
+			if err := os.MkdirAll(filepath.Dir(latestName), di.dirMode); err != nil {
+				return errors.Annotatef(err, "failed to create log dir")
+			}
+			if err = os.Symlink(latestTarget, latestName); err != nil {
+				klog.Errorf("Failed to symlink %s to %s", latestName, latestTarget)
 			} else {
-				klog.Infof("%s -> %s", latestName, latestBase)
+				klog.Infof("%s -> %s", latestName, latestTarget)
 			}
 		}
 	}
 	return nil
 }
 
+func (di *deviceInfo) Flush() error {
+	if di.w == nil {
+		return nil
+	}
+	if err := di.w.Flush(); err != nil {
+		return err
+	}
+	if di.fsync {
+		return di.fd.Sync()
+	}
+	return nil
+}
+
 func (di *deviceInfo) Close() error {
 	if di.fd != nil {
 		klog.Infof("Closed %s", di.fname)
+		if err := di.Flush(); err != nil {
+			klog.Errorf("Failed to flush %s: %v", di.fname, err)
+		}
 		err := di.fd.Close()
-		di.fd = nil
+		di.fd, di.w = nil, nil
 		return err
 	}
 	return nil
 }
 
 type FileManager struct {
+	dir            string
+	retention      time.Duration
+	nameRE         *regexp.Regexp
 	nameTmpl       *template.Template
 	latestNameTmpl *template.Template
-	recordTmpl     *template.Template
+	recordFmt      recordFormat
+	encoder        *encoding.Encoder
+	flushInterval  time.Duration
+	flushOnError   bool
+	conflictSuffix bool
+	fileMode       os.FileMode
+	dirMode        os.FileMode
+	fsync          bool
 	mu             sync.Mutex
 	devices        map[string]*deviceInfo
+	deviceSrcs     map[string]*deviceSrc
+	combinedTmpl   *template.Template
+	combined       *deviceInfo
+	maxOpenFiles   int
+	recordSep      string
+	offlineTimeout time.Duration
+	presence       map[string]*devicePresence
 }
 
 func execTmpl(t *template.Template, li *LineInfo) (string, error) {
@@ -109,38 +163,309 @@ func execTmpl(t *template.Template, li *LineInfo) (string, error) {
 func (fm *FileManager) WriteLine(li *LineInfo) {
 	fm.mu.Lock()
 	defer fm.mu.Unlock()
-	di, found := fm.devices[li.DeviceIDSafe]
+	li = fm.checkSrcLocked(li)
+	if fm.offlineTimeout > 0 {
+		fm.updatePresenceLocked(li)
+	}
+	// Latest file name identifies the stream: device and, optionally, fd.
+	latestName, err := execTmpl(fm.latestNameTmpl, li)
+	if err != nil {
+		klog.Errorf("Failed to execute file name template: %v", err)
+		return
+	}
+	di, found := fm.devices[latestName]
 	if !found {
 		di = &deviceInfo{
 			lastUsed: time.Now(),
+			fileMode: fm.fileMode,
+			dirMode:  fm.dirMode,
+			fsync:    fm.fsync,
 		}
-		fm.devices[li.DeviceIDSafe] = di
+		fm.devices[latestName] = di
 	}
-	if err := di.Open(fm.nameTmpl, fm.latestNameTmpl, li); err != nil {
+	if di.fd == nil && fm.maxOpenFiles > 0 {
+		fm.evictLocked(fm.maxOpenFiles - 1)
+	}
+	if err := di.Open(fm.nameTmpl, latestName, li); err != nil {
 		klog.Errorf("Failed to open log file: %v", err)
 		return
 	}
-	fm.recordTmpl.Execute(di.fd, li)
-	di.fd.Write([]byte{'\n'})
+	fm.writeRecordLocked(di, "", li)
+	if fm.combinedTmpl != nil {
+		if fm.combined == nil {
+			fm.combined = &deviceInfo{
+				fileMode: fm.fileMode,
+				dirMode:  fm.dirMode,
+				fsync:    fm.fsync,
+			}
+		}
+		if fm.combined.fd == nil && fm.maxOpenFiles > 0 {
+			fm.evictLocked(fm.maxOpenFiles - 1)
+		}
+		if err := fm.combined.Open(fm.combinedTmpl, "", li); err != nil {
+			klog.Errorf("Failed to open combined log file: %v", err)
+			return
+		}
+		fm.writeRecordLocked(fm.combined, li.DeviceID+" ", li)
+	}
+}
+
+// evictLocked closes least recently used files until no more than n remain open.
+func (fm *FileManager) evictLocked(n int) {
+	var open []*deviceInfo
+	for _, di := range fm.allFilesLocked() {
+		if di.fd != nil {
+			open = append(open, di)
+		}
+	}
+	if len(open) <= n {
+		return
+	}
+	sort.Slice(open, func(i, j int) bool { return open[i].lastUsed.Before(open[j].lastUsed) })
+	for _, di := range open[:len(open)-n] {
+		klog.V(1).Infof("Too many open files, evicting %s", di.fname)
+		di.Close()
+	}
+}
+
+func (fm *FileManager) writeRecordLocked(di *deviceInfo, prefix string, li *LineInfo) {
+	rec, err := fm.recordFmt.Format(li)
+	if err != nil {
+		klog.Errorf("Failed to format file record: %v", err)
+		return
+	}
+	rec = prefix + trimRecordSep(rec, fm.recordSep) + fm.recordSep
+	if fm.encoder != nil {
+		if rec, err = fm.encoder.String(rec); err != nil {
+			klog.Errorf("Failed to encode record: %v", err)
+			return
+		}
+	}
+	di.w.WriteString(rec)
+	if fm.flushInterval == 0 || (fm.flushOnError && li.Level == 0) {
+		if err := di.Flush(); err != nil {
+			klog.Errorf("Failed to write to %s: %v", di.fname, err)
+		}
+	}
 	di.lastUsed = time.Now()
 }
 
-func NewFileManager(dir, recordTmpl string) (*FileManager, error) {
-	if err := os.MkdirAll(dir, 0o755); err != nil {
+// allFilesLocked returns per-device files and the combined file, if any.
+func (fm *FileManager) allFilesLocked() []*deviceInfo {
+	res := make([]*deviceInfo, 0, len(fm.devices)+1)
+	for _, di := range fm.devices {
+		res = append(res, di)
+	}
+	if fm.combined != nil {
+		res = append(res, fm.combined)
+	}
+	return res
+}
+
+// Flush writes out buffered data of all the open files.
+func (fm *FileManager) Flush() {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	for _, di := range fm.allFilesLocked() {
+		if err := di.Flush(); err != nil {
+			klog.Errorf("Failed to write to %s: %v", di.fname, err)
+		}
+	}
+}
+
+func (fm *FileManager) flushLoop() {
+	for range time.Tick(fm.flushInterval) {
+		fm.Flush()
+	}
+}
+
+// Close closes all the files, FileManager is the sink for per-device log files.
+func (fm *FileManager) Close() error {
+	fm.CloseAll()
+	return nil
+}
+
+// CloseAll flushes and closes all the open files.
+func (fm *FileManager) CloseAll() {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	for _, di := range fm.allFilesLocked() {
+		di.Close()
+	}
+}
+
+type FileManagerOptions struct {
+	RecordFormat       string
+	Encoding           string
+	NameTemplate       string // Relative to the log dir, deviceLogName if empty.
+	LatestNameTemplate string // Relative to the log dir, latestDeviceLogName if empty.
+	SplitByFD          bool   // Use per-fd default name templates.
+	IncludeSrc         bool   // Include source address in default name templates.
+	FlatLayout         bool   // Default name templates put all the files in the log dir, without per-device subdirs.
+	Retention          time.Duration
+	FlushInterval      time.Duration // 0 means every record is written immediately.
+	FlushOnError       bool          // Write out error records immediately.
+	// Write lines of devices with the same ID but different addresses to separate files.
+	SplitConflicting bool
+	FileMode         os.FileMode
+	DirMode          os.FileMode
+	Fsync            bool // Sync files to disk after writing.
+	// If set, all the records are also written to this file, prefixed with device ID.
+	// Relative to the log dir, may contain template fields.
+	CombinedFile    string
+	RecordSeparator string // Written after each record, "\n" if empty.
+	MaxOpenFiles    int    // If the limit is reached, least recently used files are closed. 0 = no limit.
+	// If set, devices that have been silent for this long are reported offline.
+	OfflineTimeout time.Duration
+}
+
+func NewFileManager(dir string, opts *FileManagerOptions) (*FileManager, error) {
+	if err := os.MkdirAll(dir, opts.DirMode); err != nil {
 		return nil, errors.Annotatef(err, "failed to create log dir")
 	}
 	fm := &FileManager{
-		devices: make(map[string]*deviceInfo),
+		dir:            filepath.Clean(dir),
+		retention:      opts.Retention,
+		flushInterval:  opts.FlushInterval,
+		flushOnError:   opts.FlushOnError,
+		conflictSuffix: opts.SplitConflicting,
+		fileMode:       opts.FileMode,
+		dirMode:        opts.DirMode,
+		fsync:          opts.Fsync,
+		maxOpenFiles:   opts.MaxOpenFiles,
+		recordSep:      "\n",
+		offlineTimeout: opts.OfflineTimeout,
+		presence:       make(map[string]*devicePresence),
+		devices:        make(map[string]*deviceInfo),
+		deviceSrcs:     make(map[string]*deviceSrc),
+	}
+	if opts.RecordSeparator != "" {
+		fm.recordSep = opts.RecordSeparator
+	}
+	ft, err := fm.parseTemplates(opts)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	fm.setTemplatesLocked(ft)
+	enc, err := htmlindex.Get(opts.Encoding)
+	if err != nil {
+		return nil, errors.Annotatef(err, "invalid file encoding %q", opts.Encoding)
+	}
+	// UTF-8 is passed through as is.
+	if enc != encoding.Nop && enc != unicode.UTF8 {
+		fm.encoder = encoding.ReplaceUnsupported(enc.NewEncoder())
+	}
+	if fm.retention > 0 {
+		go fm.retentionLoop()
+	}
+	if fm.flushInterval > 0 {
+		go fm.flushLoop()
+	}
+	if fm.offlineTimeout > 0 {
+		go fm.presenceLoop()
+	}
+	return fm, nil
+}
+
+type fileTemplates struct {
+	name       *template.Template
+	latestName *template.Template
+	record     recordFormat
+	combined   *template.Template
+	nameRE     *regexp.Regexp
+}
+
+func (fm *FileManager) parseTemplates(opts *FileManagerOptions) (*fileTemplates, error) {
+	nameTmpl, latestNameTmpl := deviceLogName, latestDeviceLogName
+	// Streams of a device written to separate files need separate latest symlinks,
+	// otherwise the files would keep replacing each other.
+	splitByFD := opts.SplitByFD || strings.Contains(opts.NameTemplate, ".FD")
+	if splitByFD {
+		nameTmpl, latestNameTmpl = deviceFDLogName, latestDeviceFDLogName
+	}
+	if opts.IncludeSrc {
+		nameTmpl = strings.Replace(nameTmpl, "/{{.DeviceIDSafe}}.", "/{{.DeviceIDSafe}}_{{.SrcSafe}}.", 1)
+		latestNameTmpl = strings.Replace(latestNameTmpl, "/{{.DeviceIDSafe}}.", "/{{.DeviceIDSafe}}_{{.SrcSafe}}.", 1)
+	}
+	if opts.FlatLayout {
+		nameTmpl = strings.TrimPrefix(nameTmpl, "{{.DeviceIDSafe}}/")
+		latestNameTmpl = strings.TrimPrefix(latestNameTmpl, "{{.DeviceIDSafe}}/")
+		// Device IDs may contain dots, <id>.log of device "x.20220102" would be
+		// the same as the dated log of device "x".
+		latestNameTmpl = strings.TrimSuffix(latestNameTmpl, ".log") + ".latest.log"
 	}
+	if opts.NameTemplate != "" {
+		nameTmpl = opts.NameTemplate
+	}
+	if opts.LatestNameTemplate != "" {
+		latestNameTmpl = opts.LatestNameTemplate
+		if splitByFD && !strings.Contains(latestNameTmpl, ".FD") {
+			return nil, errors.Errorf("latest file name template must include .FD or .FDName when streams are written to separate files")
+		}
+	}
+	var ft fileTemplates
 	var err error
-	if fm.nameTmpl, err = template.New("filename").Parse(filepath.Join(dir, "{{.DeviceIDSafe}}", deviceLogName)); err != nil {
+	if ft.name, err = newTemplate("filename").Parse(filepath.Join(fm.dir, nameTmpl)); err != nil {
 		return nil, errors.Annotatef(err, "invalid file name template")
 	}
-	if fm.latestNameTmpl, err = template.New("filename").Parse(filepath.Join(dir, "{{.DeviceIDSafe}}", latestDeviceLogName)); err != nil {
-		return nil, errors.Annotatef(err, "invalid file name template")
+	if ft.latestName, err = newTemplate("filename").Parse(filepath.Join(fm.dir, latestNameTmpl)); err != nil {
+		return nil, errors.Annotatef(err, "invalid latest file name template")
 	}
-	if fm.recordTmpl, err = template.New("file").Parse(*flagFileFormat); err != nil {
+	if ft.record, err = parseRecordFormat("file", opts.RecordFormat); err != nil {
 		return nil, errors.Annotatef(err, "invalid file record format template")
 	}
-	return fm, nil
+	ts := []*template.Template{ft.name, ft.latestName}
+	if opts.CombinedFile != "" {
+		if ft.combined, err = newTemplate("filename").Parse(filepath.Join(fm.dir, opts.CombinedFile)); err != nil {
+			return nil, errors.Annotatef(err, "invalid combined file name template")
+		}
+		ts = append(ts, ft.combined)
+	}
+	// Catch references to non-existent fields early.
+	sample := newLineInfo(time.Now(), &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}, &logline.LineInfo{DeviceID: "dev", Msg: "msg"})
+	for _, t := range ts {
+		if _, err := execTmpl(t, sample); err != nil {
+			return nil, errors.Annotatef(err, "invalid template")
+		}
+	}
+	if _, err := ft.record.Format(sample); err != nil {
+		return nil, errors.Annotatef(err, "invalid file record format template")
+	}
+	if fm.retention > 0 {
+		if ft.nameRE, err = nameTmplRegexp(ft.name); err != nil {
+			return nil, errors.Annotatef(err, "retention is not supported with this file name template")
+		}
+	}
+	return &ft, nil
+}
+
+func (fm *FileManager) setTemplatesLocked(ft *fileTemplates) {
+	fm.nameTmpl = ft.name
+	fm.latestNameTmpl = ft.latestName
+	fm.recordFmt = ft.record
+	fm.combinedTmpl = ft.combined
+	fm.nameRE = ft.nameRE
+}
+
+// SetTemplates replaces file name and record templates.
+// If file name templates change, all the open files are closed.
+func (fm *FileManager) SetTemplates(opts *FileManagerOptions) error {
+	ft, err := fm.parseTemplates(opts)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	if ft.name.Root.String() != fm.nameTmpl.Root.String() || ft.latestName.Root.String() != fm.latestNameTmpl.Root.String() {
+		for _, di := range fm.devices {
+			di.Close()
+		}
+		fm.devices = make(map[string]*deviceInfo)
+	}
+	if fm.combined != nil && (ft.combined == nil || ft.combined.Root.String() != fm.combinedTmpl.Root.String()) {
+		fm.combined.Close()
+		fm.combined = nil
+	}
+	fm.setTemplatesLocked(ft)
+	return nil
 }
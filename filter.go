@@ -0,0 +1,103 @@
+/*
+ * Copyright (c) 2022 Deomid "rojer" Ryabkov
+ * All rights reserved
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// DeviceFilter selects devices by ID using glob patterns.
+// Deny patterns take precedence, if allow patterns are present only matching devices pass.
+type DeviceFilter struct {
+	allow []*regexp.Regexp
+	deny  []*regexp.Regexp
+}
+
+func NewDeviceFilter(allow, deny []string) (*DeviceFilter, error) {
+	df := &DeviceFilter{}
+	for _, p := range allow {
+		re, err := compileGlob(p)
+		if err != nil {
+			return nil, errors.Annotatef(err, "invalid allow pattern %q", p)
+		}
+		df.allow = append(df.allow, re)
+	}
+	for _, p := range deny {
+		re, err := compileGlob(p)
+		if err != nil {
+			return nil, errors.Annotatef(err, "invalid deny pattern %q", p)
+		}
+		df.deny = append(df.deny, re)
+	}
+	return df, nil
+}
+
+// Check returns the reason for rejecting the device or an empty string if the device is allowed.
+func (df *DeviceFilter) Check(deviceID string) string {
+	for _, re := range df.deny {
+		if re.MatchString(deviceID) {
+			return "denied"
+		}
+	}
+	if len(df.allow) == 0 {
+		return ""
+	}
+	for _, re := range df.allow {
+		if re.MatchString(deviceID) {
+			return ""
+		}
+	}
+	return "not_allowed"
+}
+
+// compileGlob converts a shell-style glob (*, ? and [...] classes) to an anchored regexp.
+func compileGlob(p string) (*regexp.Regexp, error) {
+	var sb strings.Builder
+	sb.WriteString("^")
+	for i := 0; i < len(p); i++ {
+		switch c := p[i]; c {
+		case '*':
+			sb.WriteString(".*")
+		case '?':
+			sb.WriteString(".")
+		case '[':
+			j := strings.IndexByte(p[i+1:], ']')
+			if j < 0 {
+				return nil, errors.Errorf("unterminated character class")
+			}
+			class := p[i+1 : i+1+j]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			sb.WriteString("[" + class + "]")
+			i += j + 1
+		case '\\':
+			if i+1 < len(p) {
+				i++
+			}
+			sb.WriteString(regexp.QuoteMeta(p[i : i+1]))
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	sb.WriteString("$")
+	return regexp.Compile(sb.String())
+}
@@ -5,6 +5,8 @@ go 1.18
 require (
 	github.com/juju/errors v1.0.0
 	github.com/spf13/pflag v1.0.5
+	golang.org/x/sys v0.10.0
+	golang.org/x/text v0.9.0
 	k8s.io/klog/v2 v2.80.1
 )
 
@@ -0,0 +1,104 @@
+/*
+ * Copyright (c) 2022 Deomid "rojer" Ryabkov
+ * All rights reserved
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LineGrouper merges continuation lines (e.g. backtrace frames) into the
+// preceding line from the same device. Since any line may be followed by
+// continuations, the last line from each device is held until the next
+// non-continuation line arrives or the timeout expires.
+type LineGrouper struct {
+	re       *regexp.Regexp
+	maxLines int
+	timeout  time.Duration
+	mu       sync.Mutex
+	pending  map[string]*pendingGroup
+}
+
+type pendingGroup struct {
+	li      *LineInfo
+	lines   []string
+	updated time.Time // Wall clock time of the last line.
+}
+
+func NewLineGrouper(re *regexp.Regexp, maxLines int, timeout time.Duration) *LineGrouper {
+	return &LineGrouper{
+		re:       re,
+		maxLines: maxLines,
+		timeout:  timeout,
+		pending:  make(map[string]*pendingGroup),
+	}
+}
+
+// Add feeds a line to the grouper and returns lines that are ready to be written.
+func (lg *LineGrouper) Add(li *LineInfo) []*LineInfo {
+	lg.mu.Lock()
+	defer lg.mu.Unlock()
+	now := time.Now()
+	var res []*LineInfo
+	pg := lg.pending[li.DeviceID]
+	if pg != nil && pg.li.FD == li.FD && lg.re.MatchString(li.Msg) {
+		pg.lines = append(pg.lines, li.Msg)
+		pg.updated = now
+		if len(pg.lines) >= lg.maxLines {
+			res = append(res, lg.finishLocked(pg))
+		}
+		return res
+	}
+	if pg != nil {
+		res = append(res, lg.finishLocked(pg))
+	}
+	lg.pending[li.DeviceID] = &pendingGroup{li: li, lines: []string{li.Msg}, updated: now}
+	return res
+}
+
+func (lg *LineGrouper) finishLocked(pg *pendingGroup) *LineInfo {
+	delete(lg.pending, pg.li.DeviceID)
+	pg.li.Msg = strings.Join(pg.lines, "\n")
+	return pg.li
+}
+
+// Expire returns groups that have not received continuations within the timeout.
+func (lg *LineGrouper) Expire(now time.Time) []*LineInfo {
+	lg.mu.Lock()
+	defer lg.mu.Unlock()
+	var res []*LineInfo
+	for _, pg := range lg.pending {
+		if now.Sub(pg.updated) >= lg.timeout {
+			res = append(res, lg.finishLocked(pg))
+		}
+	}
+	return res
+}
+
+// Flush returns all the pending groups.
+func (lg *LineGrouper) Flush() []*LineInfo {
+	lg.mu.Lock()
+	defer lg.mu.Unlock()
+	var res []*LineInfo
+	for _, pg := range lg.pending {
+		res = append(res, lg.finishLocked(pg))
+	}
+	return res
+}
@@ -0,0 +1,165 @@
+/*
+ * Copyright (c) 2022 Deomid "rojer" Ryabkov
+ * All rights reserved
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// HMACVerifier checks signatures of signed lines or packets.
+//
+// In line mode, a signed line has hex-encoded HMAC-SHA256 appended after the message delimiter:
+//
+//	device_id seq_num uptime fd level|message|hmac
+//
+// The HMAC is computed over everything before the last message delimiter.
+//
+// In packet mode, each packet (datagram or message) ends with a trailer line:
+//
+//	#hmac device_id hmac
+//
+// On stream inputs (tcp://, tls://, stdin and POST /ingest) a packet is the block of lines up to and including the trailer,
+// a block may not exceed 64 KiB.
+// The HMAC is computed over everything before the trailer with the key of the device,
+// and all the lines of the packet must be from that device.
+type HMACVerifier struct {
+	packetMode bool
+	defaultKey []byte
+	deviceKeys map[string][]byte
+}
+
+const hmacTrailerPrefix = "#hmac "
+
+func NewHMACVerifier(mode, key, keyFile string) (*HMACVerifier, error) {
+	hv := &HMACVerifier{deviceKeys: make(map[string][]byte)}
+	switch mode {
+	case "line":
+	case "packet":
+		hv.packetMode = true
+	default:
+		return nil, errors.Errorf("invalid mode %q", mode)
+	}
+	if key != "" {
+		hv.defaultKey = []byte(key)
+	}
+	if keyFile != "" {
+		keys, err := readDeviceKeys(keyFile)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		for id, key := range keys {
+			hv.deviceKeys[id] = []byte(key)
+		}
+	}
+	return hv, nil
+}
+
+// readDeviceKeys reads "device_id key" pairs, one per line. Empty lines and lines starting with # are ignored.
+func readDeviceKeys(fname string) (map[string]string, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, errors.Annotatef(err, "failed to open key file")
+	}
+	defer f.Close()
+	res := make(map[string]string)
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, errors.Errorf("%s:%d: expected device id and key", fname, n)
+		}
+		res[fields[0]] = fields[1]
+	}
+	return res, errors.Trace(sc.Err())
+}
+
+func (hv *HMACVerifier) keyFor(deviceID string) []byte {
+	if key := hv.deviceKeys[deviceID]; key != nil {
+		return key
+	}
+	return hv.defaultKey
+}
+
+// VerifyPacket checks the trailer of a packet in packet mode.
+// Returns the signing device and the packet data without the trailer, or false if verification failed.
+// In line mode, data is returned as is.
+func (hv *HMACVerifier) VerifyPacket(data []byte) (string, []byte, bool) {
+	if !hv.packetMode {
+		return "", data, true
+	}
+	i := bytes.LastIndex(data, []byte(hmacTrailerPrefix))
+	if i < 0 {
+		return "", nil, false
+	}
+	fields := strings.Fields(string(data[i+len(hmacTrailerPrefix):]))
+	if len(fields) != 2 {
+		return "", nil, false
+	}
+	key := hv.keyFor(fields[0])
+	sig, err := hex.DecodeString(fields[1])
+	if key == nil || err != nil {
+		return "", nil, false
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data[:i])
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return "", nil, false
+	}
+	return fields[0], data[:i], true
+}
+
+// Verify checks the signature of the raw line and, if it is valid, strips it from the message.
+// In packet mode, the line must be from authDevice, the device that signed the packet it came in.
+func (hv *HMACVerifier) Verify(li *LineInfo, line []byte, authDevice string) bool {
+	if hv.packetMode {
+		// Device is checked by checkAuth.
+		return authDevice != ""
+	}
+	key := hv.keyFor(li.DeviceID)
+	if key == nil {
+		return false
+	}
+	i := bytes.LastIndexByte(line, lineFormat.MsgDelim)
+	mi := strings.LastIndexByte(li.Msg, lineFormat.MsgDelim)
+	if i < 0 || mi < 0 {
+		return false
+	}
+	sig, err := hex.DecodeString(string(line[i+1:]))
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(line[:i])
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return false
+	}
+	li.Msg = li.Msg[:mi]
+	return true
+}
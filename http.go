@@ -0,0 +1,105 @@
+/*
+ * Copyright (c) 2022 Deomid "rojer" Ryabkov
+ * All rights reserved
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/juju/errors"
+	klog "k8s.io/klog/v2"
+)
+
+// startHTTPServer serves the tail endpoint and counters (/debug/vars).
+func startHTTPServer(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return errors.Annotatef(err, "failed to listen on %s", addr)
+	}
+	if tailBuf != nil {
+		http.HandleFunc("/tail", handleTail)
+	}
+	klog.Infof("HTTP server listening on %s", l.Addr())
+	go func() {
+		if err := http.Serve(l, nil); err != nil {
+			klog.Errorf("HTTP server error: %v", err)
+		}
+	}()
+	return nil
+}
+
+// httpSrc returns the client address of the request as a source address.
+func httpSrc(r *http.Request) *net.UDPAddr {
+	host, port, _ := net.SplitHostPort(r.RemoteAddr)
+	p, _ := strconv.Atoi(port)
+	return &net.UDPAddr{IP: net.ParseIP(host), Port: p}
+}
+
+// /tail?device=ID[&n=100][&follow=1]
+func handleTail(w http.ResponseWriter, r *http.Request) {
+	deviceID := r.FormValue("device")
+	if deviceID == "" {
+		http.Error(w, "device is required", http.StatusBadRequest)
+		return
+	}
+	n := 100
+	if ns := r.FormValue("n"); ns != "" {
+		v, err := strconv.Atoi(ns)
+		if err != nil || v < 0 {
+			http.Error(w, "invalid n", http.StatusBadRequest)
+			return
+		}
+		n = v
+	}
+	follow, _ := strconv.ParseBool(r.FormValue("follow"))
+	lines, ch, found := tailBuf.Get(deviceID, n, follow)
+	if !found {
+		http.Error(w, "unknown device", http.StatusNotFound)
+		return
+	}
+	format := getDynConfig().tailFmt
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	for _, li := range lines {
+		rec, _ := format.Format(li)
+		bw.WriteString(rec + "\n")
+	}
+	bw.Flush()
+	if ch == nil {
+		return
+	}
+	defer tailBuf.Unfollow(deviceID, ch)
+	flusher, _ := w.(http.Flusher)
+	for {
+		if flusher != nil {
+			flusher.Flush()
+		}
+		select {
+		case li := <-ch:
+			rec, _ := format.Format(li)
+			bw.WriteString(rec + "\n")
+			if err := bw.Flush(); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
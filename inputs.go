@@ -0,0 +1,247 @@
+/*
+ * Copyright (c) 2022 Deomid "rojer" Ryabkov
+ * All rights reserved
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	klog "k8s.io/klog/v2"
+)
+
+// Maximum length of a line received over a stream connection.
+const maxStreamLineLen = 64 * 1024
+
+// inputSource receives log data and passes it to the workers until an error occurs.
+type inputSource interface {
+	Run(wp *WorkerPool) error
+	Close() error
+}
+
+// Inputs that need to be closed on exit.
+var (
+	activeInputsMu sync.Mutex
+	activeInputs   []inputSource
+)
+
+func closeInputs() {
+	activeInputsMu.Lock()
+	defer activeInputsMu.Unlock()
+	for _, in := range activeInputs {
+		in.Close()
+	}
+	activeInputs = nil
+}
+
+// openInputs opens listeners for all the --listen-addr specs.
+func openInputs(specs []string) ([]inputSource, error) {
+	var res []inputSource
+	closeAll := func() {
+		for _, in := range res {
+			in.Close()
+		}
+	}
+	for _, spec := range specs {
+		u, err := parseListenURL(spec)
+		if err != nil {
+			closeAll()
+			return nil, errors.Annotatef(err, "invalid --listen-addr %q", spec)
+		}
+		// Lines are tagged with the listener they arrived on, ?tag=name overrides the default.
+		tag := u.Query().Get("tag")
+		if tag == "" {
+			tag = spec
+		}
+		// Stream listeners behind a load balancer can take the source address from the PROXY protocol header.
+		proxy, _ := strconv.ParseBool(u.Query().Get("proxy"))
+		var ins []inputSource
+		switch u.Scheme {
+		case "udp", "udp4", "udp6":
+			ins, err = openUDPInputs(spec, tag)
+		case "tcp", "tcp4", "tcp6":
+			var in inputSource
+			in, err = listenTCP(u.Scheme, u.Host, tag, proxy)
+			ins = []inputSource{in}
+		case "tls":
+			var in inputSource
+			in, err = listenTLS(u.Host, tag, *flagTLSCert, *flagTLSKey, proxy)
+			ins = []inputSource{in}
+		case "dtls", "dtls4", "dtls6":
+			var in inputSource
+			in, err = listenDTLS(strings.Replace(u.Scheme, "dtls", "udp", 1), u.Host, tag, *flagDTLSPSKFile)
+			ins = []inputSource{in}
+		case "coap", "coap4", "coap6":
+			var in inputSource
+			in, err = listenCoAP(strings.Replace(u.Scheme, "coap", "udp", 1), u.Host, tag)
+			ins = []inputSource{in}
+		case "systemd":
+			ins, err = openSystemdInputs(u.Host, tag)
+		case "stdin":
+			ins = []inputSource{newStdinInput(tag)}
+		case "unixgram":
+			var in inputSource
+			in, err = listenUnixgram(u.Host+u.Path, tag)
+			ins = []inputSource{in}
+		default:
+			err = errors.Errorf("unsupported scheme %q", u.Scheme)
+		}
+		if err != nil {
+			closeAll()
+			return nil, errors.Annotatef(err, "failed to open listener at %s", spec)
+		}
+		res = append(res, ins...)
+	}
+	activeInputsMu.Lock()
+	activeInputs = append(activeInputs, res...)
+	activeInputsMu.Unlock()
+	return res, nil
+}
+
+type udpInput struct {
+	c        *net.UDPConn
+	tag      string
+	dropAcct bool
+}
+
+func openUDPInputs(spec, tag string) ([]inputSource, error) {
+	network, addr, err := parseListenAddr(spec)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	cs, err := listenUDP(network, addr, *flagReceivers)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var res []inputSource
+	for _, c := range cs {
+		if err := setRcvBuf(c); err != nil {
+			for _, c := range cs {
+				c.Close()
+			}
+			return nil, errors.Trace(err)
+		}
+		in := &udpInput{c: c, tag: tag}
+		if err := enableRxqOvfl(c); err == nil {
+			in.dropAcct = true
+		} else {
+			klog.Warningf("Kernel drop accounting is unavailable on %s: %v", c.LocalAddr(), err)
+		}
+		res = append(res, in)
+	}
+	if addr.IP != nil {
+		klog.Infof("Listening on UDP %s...", addr)
+	} else {
+		klog.Infof("Listening on UDP port %d...", addr.Port)
+	}
+	return res, nil
+}
+
+// setRcvBuf sets receive buffer size of a datagram socket according to --rcvbuf.
+func setRcvBuf(c interface{ SetReadBuffer(int) error }) error {
+	if *flagRcvBuf <= 0 {
+		return nil
+	}
+	if err := c.SetReadBuffer(*flagRcvBuf); err != nil {
+		return errors.Annotatef(err, "failed to set receive buffer size")
+	}
+	return nil
+}
+
+func (in *udpInput) Run(wp *WorkerPool) error {
+	if *flagRecvBatch > 1 {
+		return receiveBatch(in.c, in.tag, wp, in.dropAcct, *flagRecvBatch)
+	}
+	return receive(in.c, in.tag, wp, in.dropAcct)
+}
+
+func (in *udpInput) Close() error {
+	return in.c.Close()
+}
+
+// stdinInput reads lines from standard input alongside other inputs.
+type stdinInput struct {
+	tag    string
+	closed chan struct{}
+}
+
+func newStdinInput(tag string) *stdinInput {
+	if tag == "stdin://" {
+		tag = "stdin"
+	}
+	return &stdinInput{tag: tag, closed: make(chan struct{})}
+}
+
+func (in *stdinInput) Run(wp *WorkerPool) error {
+	klog.Infof("Reading from stdin...")
+	if err := readLines(os.Stdin, replaySrc, in.tag, wp); err != nil {
+		return errors.Annotatef(err, "stdin read error")
+	}
+	// Other inputs keep running after EOF.
+	<-in.closed
+	return nil
+}
+
+func (in *stdinInput) Close() error {
+	select {
+	case <-in.closed:
+	default:
+		close(in.closed)
+	}
+	return nil
+}
+
+// streamSrc converts address of a stream connection to the source address used for lines.
+func streamSrc(a net.Addr) *net.UDPAddr {
+	if ta, ok := a.(*net.TCPAddr); ok {
+		return &net.UDPAddr{IP: ta.IP, Port: ta.Port, Zone: ta.Zone}
+	}
+	return &net.UDPAddr{}
+}
+
+// readLines reads newline-delimited lines from a stream and passes them to the workers.
+// Unlike datagrams, lines are never dropped if the queue is full, the reader waits instead.
+// In HMAC packet mode, lines are passed on in blocks that end with the trailer line, so the block is verified as a whole.
+func readLines(r io.Reader, src *net.UDPAddr, listener string, wp *WorkerPool) error {
+	framed := hmacVerifier != nil && hmacVerifier.packetMode
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, maxStreamLineLen)
+	var block []byte
+	for sc.Scan() {
+		line := sc.Bytes()
+		rxBytes.Add(int64(len(line) + 1))
+		block = append(append(block, line...), '\n')
+		if framed && !bytes.HasPrefix(line, []byte(hmacTrailerPrefix)) && len(block) <= maxStreamLineLen {
+			continue
+		}
+		wp.EnqueueWait(&packet{ts: time.Now(), src: src, data: block, listener: listener})
+		block = nil
+	}
+	if len(block) > 0 {
+		// Lines without a trailer, these will fail verification.
+		wp.EnqueueWait(&packet{ts: time.Now(), src: src, data: block, listener: listener})
+	}
+	return sc.Err()
+}
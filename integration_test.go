@@ -0,0 +1,233 @@
+/*
+ * Copyright (c) 2022 Deomid "rojer" Ryabkov
+ * All rights reserved
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// When set, the test binary runs main() instead of tests, this is used to run the catcher as a subprocess.
+const runMainEnv = "MOS_UDP_LOG_CATCHER_RUN_MAIN"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(runMainEnv) != "" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// startCatcher runs the catcher with the specified arguments, in UTC.
+// Stdout is collected in the returned buffer, which may only be read after the process exits.
+// waitFor is a substring of a log message to wait for before returning, if not empty.
+func startCatcher(t *testing.T, waitFor string, args ...string) (*exec.Cmd, *bytes.Buffer) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), runMainEnv+"=1", "TZ=UTC")
+	stdout := &bytes.Buffer{}
+	cmd.Stdout = stdout
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cmd.Process.Kill() })
+	found := make(chan bool, 1)
+	go func() {
+		sc := bufio.NewScanner(stderr)
+		for sc.Scan() {
+			t.Logf("catcher: %s", sc.Text())
+			if waitFor != "" && strings.Contains(sc.Text(), waitFor) {
+				found <- true
+			}
+		}
+		io.Copy(io.Discard, stderr)
+	}()
+	if waitFor != "" {
+		select {
+		case <-found:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("catcher did not log %q", waitFor)
+		}
+	}
+	return cmd, stdout
+}
+
+func freePort(t *testing.T) int {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// getCounter returns the value of an integer counter or an element of a map counter ("name.key") from /debug/vars.
+func getCounter(t *testing.T, httpAddr, name string) int64 {
+	t.Helper()
+	resp, err := http.Get("http://" + httpAddr + "/debug/vars")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var vars map[string]json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&vars); err != nil {
+		t.Fatal(err)
+	}
+	name, key, isMap := strings.Cut(name, ".")
+	var v int64
+	if isMap {
+		var m map[string]int64
+		json.Unmarshal(vars[name], &m)
+		v = m[key]
+	} else {
+		json.Unmarshal(vars[name], &v)
+	}
+	return v
+}
+
+// checkDeviceLog checks that the device's log for the date contains the messages and the latest symlink points to latestDate's log.
+func checkDeviceLog(t *testing.T, logDir, deviceID, date, latestDate string, msgs ...string) {
+	t.Helper()
+	fname := filepath.Join(logDir, deviceID, fmt.Sprintf("%s.%s.log", deviceID, date))
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, msg := range msgs {
+		if !bytes.Contains(data, []byte(msg)) {
+			t.Errorf("%s does not contain %q:\n%s", fname, msg, data)
+		}
+	}
+	latestName := filepath.Join(logDir, deviceID, deviceID+".log")
+	target, err := os.Readlink(latestName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := fmt.Sprintf("%s.%s.log", deviceID, latestDate); target != want {
+		t.Errorf("%s points to %s, want %s", latestName, target, want)
+	}
+}
+
+// TestUDPRoundTrip sends datagrams to a running catcher and checks the files, stdout and counters.
+func TestUDPRoundTrip(t *testing.T) {
+	logDir := t.TempDir()
+	udpPort, httpAddr := freePort(t), fmt.Sprintf("127.0.0.1:%d", freePort(t))
+	cmd, stdout := startCatcher(t, "Listening on UDP",
+		fmt.Sprintf("--listen-addr=udp://127.0.0.1:%d/", udpPort), "--log-dir="+logDir,
+		"--http-addr="+httpAddr, "--stdout", "--stdout-format={{.DeviceID}} {{.SeqNum}} {{.LevelChar}} {{.Msg}}")
+	c, err := net.Dial("udp", fmt.Sprintf("127.0.0.1:%d", udpPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for _, pkt := range []string{
+		"dev1 1 1.000 1 2|first\ndev1 2 1.100 1 0|second\n", // Multiple lines per packet.
+		"this is not a valid line\n",
+		"dev2 1 5.000 1 2|line split bet", // Continued in the next packet.
+		"ween packets\n",
+		"dev1 3 1.200 1 x|bad level\n",
+	} {
+		if _, err := c.Write([]byte(pkt)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for getCounter(t, httpAddr, "parsed_lines") < 3 || getCounter(t, httpAddr, "parse_errors") < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("lines were not processed")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if v := getCounter(t, httpAddr, "malformed_lines.bad_level"); v != 1 {
+		t.Errorf("malformed_lines.bad_level = %d, want 1", v)
+	}
+	cmd.Process.Signal(syscall.SIGTERM)
+	cmd.Wait()
+	today := time.Now().UTC().Format("20060102")
+	checkDeviceLog(t, logDir, "dev1", today, today, "I first", "E second")
+	checkDeviceLog(t, logDir, "dev2", today, today, "I line split between packets")
+	for _, want := range []string{"dev1 1 I first\n", "dev1 2 E second\n", "dev2 1 I line split between packets\n"} {
+		if !strings.Contains(stdout.String(), want) {
+			t.Errorf("stdout does not contain %q:\n%s", want, stdout)
+		}
+	}
+	if strings.Contains(stdout.String(), "not a valid line") || strings.Contains(stdout.String(), "bad level") {
+		t.Errorf("stdout contains malformed lines:\n%s", stdout)
+	}
+}
+
+// writePcap writes UDP packets sent to port at the specified times as a raw IPv4 capture.
+func writePcap(t *testing.T, fname string, port int, times []time.Time, payloads []string) {
+	t.Helper()
+	var buf bytes.Buffer
+	// Magic, version 2.4, zone, sigfigs, snaplen, link type.
+	binary.Write(&buf, binary.LittleEndian, []uint32{0xa1b2c3d4, 0x00040002, 0, 0, 65535, linkTypeIPv4})
+	for i, payload := range payloads {
+		ip := make([]byte, 28, 28+len(payload))
+		ip[0], ip[8], ip[9] = 0x45, 64, 17
+		binary.BigEndian.PutUint16(ip[2:4], uint16(len(ip)+len(payload)))
+		copy(ip[12:16], []byte{10, 0, 0, 2})
+		copy(ip[16:20], []byte{10, 0, 0, 1})
+		binary.BigEndian.PutUint16(ip[20:22], 12345)
+		binary.BigEndian.PutUint16(ip[22:24], uint16(port))
+		binary.BigEndian.PutUint16(ip[24:26], uint16(8+len(payload)))
+		ip = append(ip, payload...)
+		binary.Write(&buf, binary.LittleEndian, []uint32{uint32(times[i].Unix()), uint32(times[i].Nanosecond() / 1000), uint32(len(ip)), uint32(len(ip))})
+		buf.Write(ip)
+	}
+	if err := os.WriteFile(fname, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestDayRollover replays a capture with packet timestamps on both sides of midnight.
+func TestDayRollover(t *testing.T) {
+	logDir, pcapFile := t.TempDir(), filepath.Join(t.TempDir(), "test.pcap")
+	midnight := time.Date(2022, 1, 2, 0, 0, 0, 0, time.UTC)
+	writePcap(t, pcapFile, 1993,
+		[]time.Time{midnight.Add(-time.Second), midnight.Add(time.Second)},
+		[]string{"dev1 1 10 1 2|before midnight\n", "dev1 2 12 1 2|after midnight\n"})
+	cmd, _ := startCatcher(t, "", "--pcap-file="+pcapFile, "--pcap-port=1993", "--log-dir="+logDir)
+	if err := cmd.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	checkDeviceLog(t, logDir, "dev1", "20220101", "20220102", "before midnight")
+	checkDeviceLog(t, logDir, "dev1", "20220102", "20220102", "after midnight")
+	data, _ := os.ReadFile(filepath.Join(logDir, "dev1", "dev1.20220102.log"))
+	if bytes.Contains(data, []byte("before midnight")) {
+		t.Errorf("line from before midnight is in the next day's log:\n%s", data)
+	}
+}
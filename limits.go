@@ -0,0 +1,54 @@
+/*
+ * Copyright (c) 2022 Deomid "rojer" Ryabkov
+ * All rights reserved
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"net"
+
+	"github.com/rojer/mos_udp_log_catcher/logline"
+	klog "k8s.io/klog/v2"
+)
+
+// checkPayloadLen returns false if the payload (after decompression) is too big to process.
+func checkPayloadLen(src *net.UDPAddr, data []byte) bool {
+	if *flagMaxPayload > 0 && len(data) > *flagMaxPayload {
+		limitExceeded.Add("payload_size", 1)
+		klog.V(1).Infof("Dropped %d byte payload from %s, limit is %d", len(data), src, *flagMaxPayload)
+		return false
+	}
+	return true
+}
+
+// limitLines returns at most --max-packet-lines of the lines from a single packet, the rest are counted and dropped.
+func limitLines(src *net.UDPAddr, lines [][]byte) [][]byte {
+	if *flagMaxPktLines <= 0 || len(lines) <= *flagMaxPktLines {
+		return lines
+	}
+	limitExceeded.Add("packet_lines", int64(len(lines)-*flagMaxPktLines))
+	klog.V(1).Infof("Dropped %d lines from %s, limit is %d per packet", len(lines)-*flagMaxPktLines, src, *flagMaxPktLines)
+	return lines[:*flagMaxPktLines]
+}
+
+// checkNUL returns an error if the line contains NUL bytes and these are not allowed.
+func checkNUL(line []byte) error {
+	if !*flagAllowNUL && bytes.IndexByte(line, 0) >= 0 {
+		return &logline.Error{Reason: "nul_byte", Msg: "line contains NUL bytes"}
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+/*
+ * Copyright (c) 2022 Deomid "rojer" Ryabkov
+ * All rights reserved
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// tmplLogfmt formats the line as logfmt key=value pairs:
+//
+//	ts=2022-01-02T03:04:05.678Z device=esp32_123456 src=10.0.0.2:1234 seq=7 fd=1 level=info msg="hello world"
+//
+// Fields follow the message, in alphabetical order.
+// Used for --stdout-format=logfmt and --file-format=logfmt.
+func tmplLogfmt(li *LineInfo) string {
+	var sb strings.Builder
+	logfmtPair(&sb, "ts", li.Timestamp.Format(time.RFC3339Nano))
+	logfmtPair(&sb, "device", li.DeviceID)
+	if li.Src != nil {
+		logfmtPair(&sb, "src", li.Src.String())
+	}
+	logfmtPair(&sb, "seq", strconv.FormatUint(li.SeqNum, 10))
+	logfmtPair(&sb, "fd", li.FDName)
+	logfmtPair(&sb, "level", li.LevelName)
+	if !li.DeviceTime.IsZero() {
+		logfmtPair(&sb, "device_time", li.DeviceTime.Format(time.RFC3339Nano))
+	}
+	logfmtPair(&sb, "msg", li.Msg)
+	keys := make([]string, 0, len(li.Fields))
+	for k := range li.Fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		logfmtPair(&sb, logfmtKey(k), li.Fields[k])
+	}
+	return sb.String()
+}
+
+func logfmtPair(sb *strings.Builder, key, value string) {
+	if sb.Len() > 0 {
+		sb.WriteByte(' ')
+	}
+	sb.WriteString(key)
+	sb.WriteByte('=')
+	if value == "" || strings.IndexFunc(value, func(r rune) bool {
+		return r <= ' ' || r == '=' || r == '"' || r == 0x7f || r == '�'
+	}) >= 0 {
+		value = strconv.Quote(value)
+	}
+	sb.WriteString(value)
+}
+
+// logfmtKey replaces characters that are not allowed in keys.
+func logfmtKey(k string) string {
+	if k == "" {
+		return "_"
+	}
+	return strings.Map(func(r rune) rune {
+		if r <= ' ' || r == '=' || r == '"' || r == 0x7f {
+			return '_'
+		}
+		return r
+	}, k)
+}
@@ -0,0 +1,289 @@
+/*
+ * Copyright (c) 2022 Deomid "rojer" Ryabkov
+ * All rights reserved
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package logline
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// CBOR is the parser of CBOR-encoded (RFC 8949) lines. Each line is an array:
+//
+//	[device_id, seq, uptime, fd, level, msg]
+//
+// or a map with "id", "seq", "uptime", "fd", "level" and "msg" keys (or integer keys 0-5, in that order).
+// Uptime is in seconds, level can be a number or a name. Other map entries are stored in Fields.
+// Since binary data can contain newlines, a packet is decoded as a sequence of items by ParsePacket.
+// Only definite-length items are supported.
+var CBOR = cborParser{}
+
+type cborParser struct{}
+
+// Parse parses a single item.
+func (cborParser) Parse(line []byte) (*LineInfo, error) {
+	v, rest, err := cborDecode(line, 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) != 0 {
+		return nil, newError("bad_cbor", "trailing data after CBOR item")
+	}
+	return cborLineInfo(v)
+}
+
+// ParsePacket parses a sequence of items.
+// If an item is invalid, lines decoded before it are returned along with the error.
+func (cborParser) ParsePacket(data []byte) ([]*LineInfo, error) {
+	var res []*LineInfo
+	for len(data) > 0 {
+		v, rest, err := cborDecode(data, 0)
+		if err != nil {
+			return res, err
+		}
+		li, err := cborLineInfo(v)
+		if err != nil {
+			return res, err
+		}
+		res = append(res, li)
+		data = rest
+	}
+	return res, nil
+}
+
+var cborKeys = []string{"id", "seq", "uptime", "fd", "level", "msg"}
+
+func cborLineInfo(v interface{}) (*LineInfo, error) {
+	vals := make(map[string]interface{})
+	var li LineInfo
+	switch item := v.(type) {
+	case []interface{}:
+		if len(item) != len(cborKeys) {
+			return nil, newError("num_parts", "invalid number of CBOR array elements: %d, expected %d", len(item), len(cborKeys))
+		}
+		for i, k := range cborKeys {
+			vals[k] = item[i]
+		}
+	case map[interface{}]interface{}:
+		for k, v := range item {
+			switch k := k.(type) {
+			case string:
+				vals[k] = v
+			case uint64:
+				if k < uint64(len(cborKeys)) {
+					vals[cborKeys[k]] = v
+				} else {
+					vals[strconv.FormatUint(k, 10)] = v
+				}
+			}
+		}
+	default:
+		return nil, newError("bad_cbor", "CBOR item must be an array or a map")
+	}
+	for k, v := range vals {
+		var ok bool
+		switch k {
+		case "id":
+			if li.DeviceID, ok = cborString(v); ok {
+				if err := checkDeviceID([]byte(li.DeviceID)); err != nil {
+					return nil, err
+				}
+			}
+		case "msg":
+			li.Msg, ok = cborString(v)
+		case "seq":
+			li.SeqNum, ok = v.(uint64)
+		case "fd":
+			var n uint64
+			n, ok = v.(uint64)
+			li.FD = uint(n)
+		case "uptime":
+			switch v := v.(type) {
+			case uint64:
+				li.UptimeMs, ok = v*1000, true
+			case float64:
+				li.UptimeMs, ok = uint64(v*1000), v >= 0
+			}
+		case "level":
+			switch v := v.(type) {
+			case uint64:
+				li.Level, ok = uint(v), true
+			case string:
+				li.Level, ok = ParseLevel(v)
+			}
+		default:
+			if li.Fields == nil {
+				li.Fields = make(map[string]string)
+			}
+			if s, isStr := cborString(v); isStr {
+				li.Fields[k] = s
+			} else {
+				li.Fields[k] = fmt.Sprint(v)
+			}
+			ok = true
+		}
+		if !ok {
+			return nil, newError("bad_"+k, "invalid %s: %v", k, v)
+		}
+	}
+	if li.DeviceID == "" {
+		return nil, newError("device_id_empty", "empty device id")
+	}
+	return &li, nil
+}
+
+func cborString(v interface{}) (string, bool) {
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case []byte:
+		return string(v), true
+	}
+	return "", false
+}
+
+const cborMaxDepth = 8
+
+// cborDecode decodes one item, returns it and the remaining data.
+// Values are uint64, int64, float64, bool, nil, string, []byte, []interface{} and map[interface{}]interface{}.
+func cborDecode(b []byte, depth int) (interface{}, []byte, error) {
+	if depth > cborMaxDepth {
+		return nil, nil, newError("bad_cbor", "CBOR nesting is too deep")
+	}
+	if len(b) == 0 {
+		return nil, nil, newError("bad_cbor", "truncated CBOR item")
+	}
+	major, info := b[0]>>5, b[0]&0x1f
+	b = b[1:]
+	if major == 7 {
+		switch info {
+		case 20:
+			return false, b, nil
+		case 21:
+			return true, b, nil
+		case 22, 23:
+			return nil, b, nil
+		case 25:
+			if len(b) < 2 {
+				break
+			}
+			return halfToFloat(binary.BigEndian.Uint16(b)), b[2:], nil
+		case 26:
+			if len(b) < 4 {
+				break
+			}
+			return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), b[4:], nil
+		case 27:
+			if len(b) < 8 {
+				break
+			}
+			return math.Float64frombits(binary.BigEndian.Uint64(b)), b[8:], nil
+		}
+		return nil, nil, newError("bad_cbor", "unsupported or truncated CBOR simple value %d", info)
+	}
+	var n uint64
+	switch {
+	case info < 24:
+		n = uint64(info)
+	case info <= 27:
+		size := 1 << (info - 24)
+		if len(b) < size {
+			return nil, nil, newError("bad_cbor", "truncated CBOR item")
+		}
+		for _, c := range b[:size] {
+			n = n<<8 | uint64(c)
+		}
+		b = b[size:]
+	default:
+		return nil, nil, newError("bad_cbor", "unsupported CBOR length encoding %d", info)
+	}
+	switch major {
+	case 0:
+		return n, b, nil
+	case 1:
+		if n > math.MaxInt64 {
+			return nil, nil, newError("bad_cbor", "CBOR integer overflow")
+		}
+		return -1 - int64(n), b, nil
+	case 2, 3:
+		if n > uint64(len(b)) {
+			return nil, nil, newError("bad_cbor", "truncated CBOR string")
+		}
+		if major == 2 {
+			return b[:n], b[n:], nil
+		}
+		return string(b[:n]), b[n:], nil
+	case 4:
+		// Each element takes at least one byte.
+		if n > uint64(len(b)) {
+			return nil, nil, newError("bad_cbor", "truncated CBOR array")
+		}
+		arr := make([]interface{}, n)
+		for i := range arr {
+			var err error
+			if arr[i], b, err = cborDecode(b, depth+1); err != nil {
+				return nil, nil, err
+			}
+		}
+		return arr, b, nil
+	case 5:
+		if n > uint64(len(b))/2 {
+			return nil, nil, newError("bad_cbor", "truncated CBOR map")
+		}
+		m := make(map[interface{}]interface{}, n)
+		for i := uint64(0); i < n; i++ {
+			var k, v interface{}
+			var err error
+			if k, b, err = cborDecode(b, depth+1); err != nil {
+				return nil, nil, err
+			}
+			if v, b, err = cborDecode(b, depth+1); err != nil {
+				return nil, nil, err
+			}
+			switch k.(type) {
+			case string, uint64:
+				m[k] = v
+			}
+		}
+		return m, b, nil
+	default: // 6, tag: the tagged item is used as is.
+		return cborDecode(b, depth+1)
+	}
+}
+
+func halfToFloat(h uint16) float64 {
+	exp, mant := int(h>>10)&0x1f, float64(h&0x3ff)
+	var v float64
+	switch exp {
+	case 0:
+		v = math.Ldexp(mant, -24)
+	case 31:
+		if mant == 0 {
+			v = math.Inf(1)
+		} else {
+			v = math.NaN()
+		}
+	default:
+		v = math.Ldexp(mant+1024, exp-25)
+	}
+	if h&0x8000 != 0 {
+		return -v
+	}
+	return v
+}
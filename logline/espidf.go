@@ -0,0 +1,69 @@
+/*
+ * Copyright (c) 2022 Deomid "rojer" Ryabkov
+ * All rights reserved
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package logline
+
+import (
+	"bytes"
+	"strconv"
+)
+
+// ParseESPIDF parses ESP-IDF console log output:
+//
+//	E (12345) tag: message
+//
+// Level letter is mapped to level, the timestamp (milliseconds since boot) to uptime
+// and the tag is stored in Fields as "tag". ANSI color codes around the line are removed.
+// The line has no device ID, so it is left empty.
+func ParseESPIDF(line []byte) (*LineInfo, error) {
+	line = trimColor(line)
+	if len(line) < 4 || line[1] != ' ' || line[2] != '(' {
+		return nil, newError("num_parts", "not an ESP-IDF log line")
+	}
+	var li LineInfo
+	level, ok := ParseLevel(string(line[:1]))
+	if !ok || line[0] < 'A' || line[0] > 'Z' {
+		return nil, newError("bad_level", "invalid level %s", quote(line[:1]))
+	}
+	li.Level = level
+	ts, rest, found := bytes.Cut(line[3:], []byte(") "))
+	if !found {
+		return nil, newError("bad_uptime", "missing timestamp")
+	}
+	ms, err := strconv.ParseUint(string(ts), 10, 64)
+	if err != nil {
+		return nil, newError("bad_uptime", "invalid timestamp %s", quote(ts))
+	}
+	li.UptimeMs = ms
+	tag, msg, found := bytes.Cut(rest, []byte(": "))
+	if !found {
+		return nil, newError("no_delimiter", "missing tag")
+	}
+	li.Fields = map[string]string{"tag": string(tag)}
+	li.Msg = string(msg)
+	return &li, nil
+}
+
+// trimColor removes a leading color escape sequence and trailing reset, e.g. "\x1b[0;31m...\x1b[0m".
+func trimColor(line []byte) []byte {
+	if bytes.HasPrefix(line, []byte("\x1b[")) {
+		if i := bytes.IndexByte(line, 'm'); i > 0 {
+			line = line[i+1:]
+		}
+	}
+	return bytes.TrimSuffix(line, []byte("\x1b[0m"))
+}
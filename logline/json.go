@@ -0,0 +1,106 @@
+/*
+ * Copyright (c) 2022 Deomid "rojer" Ryabkov
+ * All rights reserved
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package logline
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+)
+
+// ParseJSON parses a line containing a JSON object:
+//
+//	{"id": "dev1", "seq": 1, "uptime": 1.234, "fd": 1, "level": 2, "msg": "hello"}
+//
+// id and msg are required. Uptime is in seconds, level can be a number or a name.
+// Other members are stored in Fields: strings as is, other values as JSON.
+func ParseJSON(line []byte) (*LineInfo, error) {
+	var obj map[string]json.RawMessage
+	d := json.NewDecoder(bytes.NewReader(line))
+	d.UseNumber()
+	if err := d.Decode(&obj); err != nil {
+		return nil, newError("bad_json", "invalid JSON: %s", err)
+	}
+	var li LineInfo
+	id, ok := jsonString(obj["id"])
+	if !ok {
+		return nil, newError("device_id_empty", "missing or invalid id")
+	}
+	if err := checkDeviceID([]byte(id)); err != nil {
+		return nil, err
+	}
+	li.DeviceID = id
+	if li.Msg, ok = jsonString(obj["msg"]); !ok {
+		return nil, newError("no_msg", "missing or invalid msg")
+	}
+	if v, found := obj["seq"]; found {
+		n, err := strconv.ParseUint(string(v), 10, 64)
+		if err != nil {
+			return nil, newError("bad_seqnum", "invalid seq %s", quote(v))
+		}
+		li.SeqNum = n
+	}
+	if v, found := obj["uptime"]; found {
+		f, err := strconv.ParseFloat(string(v), 64)
+		if err != nil || f < 0 {
+			return nil, newError("bad_uptime", "invalid uptime %s", quote(v))
+		}
+		li.UptimeMs = uint64(f * 1000)
+	}
+	if v, found := obj["fd"]; found {
+		n, err := strconv.ParseUint(string(v), 10, 32)
+		if err != nil {
+			return nil, newError("bad_fd", "invalid fd %s", quote(v))
+		}
+		li.FD = uint(n)
+	}
+	if v, found := obj["level"]; found {
+		s, isStr := jsonString(v)
+		if !isStr {
+			s = string(v)
+		}
+		l, ok := ParseLevel(s)
+		if !ok {
+			return nil, newError("bad_level", "invalid level %s", quote(v))
+		}
+		li.Level = l
+	}
+	for k, v := range obj {
+		switch k {
+		case "id", "msg", "seq", "uptime", "fd", "level":
+			continue
+		}
+		if li.Fields == nil {
+			li.Fields = make(map[string]string)
+		}
+		if s, ok := jsonString(v); ok {
+			li.Fields[k] = s
+		} else {
+			li.Fields[k] = string(v)
+		}
+	}
+	return &li, nil
+}
+
+func jsonString(v json.RawMessage) (string, bool) {
+	var s string
+	if v == nil || json.Unmarshal(v, &s) != nil {
+		return "", false
+	}
+	return s, true
+}
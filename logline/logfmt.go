@@ -0,0 +1,83 @@
+/*
+ * Copyright (c) 2022 Deomid "rojer" Ryabkov
+ * All rights reserved
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package logline
+
+import (
+	"strconv"
+	"strings"
+)
+
+// ParseLogfmt extracts key=value pairs from a message, e.g.
+//
+//	connected to broker host=mqtt.local port=8883 err="timed out"
+//
+// Quoted values may contain spaces and Go escapes, a trailing comma after an unquoted
+// value is dropped. Words that are not pairs are skipped.
+// Returns nil if there are no pairs.
+func ParseLogfmt(s string) map[string]string {
+	var res map[string]string
+	for i := 0; i < len(s); {
+		if s[i] == ' ' || s[i] == '\t' {
+			i++
+			continue
+		}
+		ks := i
+		for i < len(s) && s[i] != ' ' && s[i] != '\t' && s[i] != '=' && s[i] != '"' {
+			i++
+		}
+		key := s[ks:i]
+		if i >= len(s) || s[i] != '=' || key == "" {
+			// Not a pair, skip the rest of the word.
+			for i < len(s) && s[i] != ' ' && s[i] != '\t' {
+				i++
+			}
+			continue
+		}
+		i++
+		var value string
+		if i < len(s) && s[i] == '"' {
+			vs := i
+			for i++; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' {
+					i++
+				}
+			}
+			if i >= len(s) {
+				// Unterminated quote, take the rest as is.
+				value = s[vs+1:]
+			} else {
+				i++
+				var err error
+				if value, err = strconv.Unquote(s[vs:i]); err != nil {
+					value = s[vs+1 : i-1]
+				}
+			}
+		} else {
+			vs := i
+			for i < len(s) && s[i] != ' ' && s[i] != '\t' {
+				i++
+			}
+			value = strings.TrimSuffix(s[vs:i], ",")
+		}
+		if res == nil {
+			res = make(map[string]string)
+		}
+		res[key] = value
+	}
+	return res
+}
@@ -0,0 +1,245 @@
+/*
+ * Copyright (c) 2022 Deomid "rojer" Ryabkov
+ * All rights reserved
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package logline parses log lines sent by Mongoose OS UDP logging:
+//
+//	device_id seq_num uptime fd level|message
+//
+// Delimiters of this format can be changed with NewFormat.
+//
+// Parsers are available by name through the registry (LookupParser, RegisterParser):
+// mos (the format above), json (one JSON object per line), cbor (CBOR-encoded records,
+// parsed a packet at a time), esp-idf (ESP-IDF console output), syslog5424 and syslog3164
+// (RFC 5424 and BSD syslog).
+// NewRegexParser creates a parser for lines matched by a regular expression with named groups,
+// and ParseLogfmt extracts key=value pairs from messages.
+package logline
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MaxDeviceIDLen is the maximum length of the device ID.
+const MaxDeviceIDLen = 50
+
+// Limits on the header, to reject garbage before spending time on it.
+const (
+	MaxHeaderLen = 256 // Entire header, including delimiters.
+	MaxTokenLen  = 32  // Numeric header fields.
+)
+
+// LineInfo contains the fields of a log line.
+type LineInfo struct {
+	DeviceID string
+	SeqNum   uint64
+	UptimeMs uint64
+	FD       uint
+	Level    uint
+	Msg      string
+	// Time reported by the sender, if the format has it.
+	Time time.Time
+	// Additional format-specific fields, e.g. syslog app name and structured data.
+	Fields map[string]string
+}
+
+// Error describes a malformed line. Reason is a short identifier suitable
+// for use as a metric label, e.g. "device_id_too_long".
+type Error struct {
+	Reason string
+	Msg    string
+}
+
+func (e *Error) Error() string {
+	return e.Msg
+}
+
+func newError(reason, format string, args ...interface{}) *Error {
+	return &Error{Reason: reason, Msg: fmt.Sprintf(format, args...)}
+}
+
+// quote returns the value quoted and truncated to a reasonable length for error messages.
+func quote(b []byte) string {
+	const maxLen = 64
+	if len(b) > maxLen {
+		return fmt.Sprintf("%q...", b[:maxLen])
+	}
+	return fmt.Sprintf("%q", b)
+}
+
+// Format specifies delimiters of the header fields and the message.
+type Format struct {
+	FieldDelim byte
+	MsgDelim   byte
+	// If set, lines with empty or invalid device ID are accepted with empty DeviceID.
+	DeviceIDOptional bool
+}
+
+// DefaultFormat is the format used by Mongoose OS: space-separated header, "|" before the message.
+var DefaultFormat = &Format{FieldDelim: ' ', MsgDelim: '|'}
+
+// NewFormat returns a format with the specified delimiters, which must be single distinct bytes.
+func NewFormat(fieldDelim, msgDelim string) (*Format, error) {
+	if len(fieldDelim) != 1 || len(msgDelim) != 1 {
+		return nil, fmt.Errorf("delimiters must be single bytes, got %q and %q", fieldDelim, msgDelim)
+	}
+	if fieldDelim == msgDelim {
+		return nil, fmt.Errorf("field and message delimiters must be different")
+	}
+	return &Format{FieldDelim: fieldDelim[0], MsgDelim: msgDelim[0]}, nil
+}
+
+// Parse parses a single line in the default format.
+func Parse(line []byte) (*LineInfo, error) {
+	return DefaultFormat.Parse(line)
+}
+
+// Parse parses a single line, without the trailing newline.
+// Errors returned are of type *Error.
+func (f *Format) Parse(line []byte) (*LineInfo, error) {
+	infoStr, msg, found := bytes.Cut(line, []byte{f.MsgDelim})
+	if !found {
+		return nil, newError("no_delimiter", "missing msg delimiter")
+	}
+	if len(infoStr) > MaxHeaderLen {
+		return nil, newError("header_too_long", "header %s is too long: %d > %d", quote(infoStr), len(infoStr), MaxHeaderLen)
+	}
+	// Repeated and trailing delimiters between the header fields are tolerated.
+	var parts [][]byte
+	if f.FieldDelim == ' ' {
+		parts = bytes.Fields(infoStr)
+	} else {
+		parts = bytes.FieldsFunc(infoStr, func(r rune) bool { return r == rune(f.FieldDelim) })
+	}
+	if len(parts) == 4 {
+		if f.DeviceIDOptional {
+			parts = append([][]byte{nil}, parts...)
+		} else if infoStr[0] == f.FieldDelim {
+			return nil, newError("device_id_empty", "empty device id")
+		}
+	}
+	if len(parts) != 5 {
+		return nil, newError("num_parts", "invalid number of parts in header %s: %d, expected 5", quote(infoStr), len(parts))
+	}
+	for _, p := range parts[1:] {
+		if len(p) > MaxTokenLen {
+			return nil, newError("token_too_long", "header field %s is too long: %d > %d", quote(p), len(p), MaxTokenLen)
+		}
+	}
+	var li LineInfo
+	if err := checkDeviceID(parts[0]); err == nil {
+		li.DeviceID = string(parts[0])
+	} else if !f.DeviceIDOptional {
+		return nil, err
+	}
+	if v, err := strconv.ParseUint(string(parts[1]), 10, 64); err == nil {
+		li.SeqNum = v
+	} else {
+		return nil, newError("bad_seqnum", "invalid seqnum %s", quote(parts[1]))
+	}
+	if v, err := strconv.ParseFloat(string(parts[2]), 64); err == nil {
+		li.UptimeMs = uint64(v * 1000)
+	} else {
+		return nil, newError("bad_uptime", "invalid uptime %s", quote(parts[2]))
+	}
+	if v, err := strconv.ParseUint(string(parts[3]), 10, 32); err == nil {
+		li.FD = uint(v)
+	} else {
+		return nil, newError("bad_fd", "invalid fd %s", quote(parts[3]))
+	}
+	if v, err := strconv.ParseUint(string(parts[4]), 10, 32); err == nil {
+		li.Level = uint(v)
+	} else {
+		return nil, newError("bad_level", "invalid level %s", quote(parts[4]))
+	}
+	li.Msg = string(msg)
+	return &li, nil
+}
+
+func checkDeviceID(id []byte) error {
+	if len(id) == 0 {
+		return newError("device_id_empty", "empty device id")
+	}
+	if len(id) > MaxDeviceIDLen {
+		return newError("device_id_too_long", "device id %s is too long: %d > %d", quote(id), len(id), MaxDeviceIDLen)
+	}
+	for _, c := range id {
+		if c < 0x20 || c == 0x7f {
+			return newError("device_id_bad_chars", "device id %s contains control characters", quote(id))
+		}
+	}
+	return nil
+}
+
+// ParseLevel parses a level: a number or a name, e.g. E or error, W or warning, I, D, V.
+func ParseLevel(s string) (uint, bool) {
+	if v, err := strconv.ParseUint(s, 10, 32); err == nil {
+		return uint(v), true
+	}
+	switch strings.ToUpper(s) {
+	case "E", "ERR", "ERROR":
+		return 0, true
+	case "W", "WARN", "WARNING":
+		return 1, true
+	case "I", "INFO":
+		return 2, true
+	case "D", "DEBUG":
+		return 3, true
+	case "V", "VERBOSE":
+		return 4, true
+	}
+	return 0, false
+}
+
+// LevelChar returns a single character representing the level: E, W, I, D, V.
+func LevelChar(level uint) string {
+	switch level {
+	case 0:
+		return "E"
+	case 1:
+		return "W"
+	case 2:
+		return "I"
+	case 3:
+		return "D"
+	case 4:
+		return "V"
+	default:
+		return fmt.Sprintf("%d", level%10)
+	}
+}
+
+// LevelName returns the full name of the level: error, warning, info, debug, verbose.
+func LevelName(level uint) string {
+	switch level {
+	case 0:
+		return "error"
+	case 1:
+		return "warning"
+	case 2:
+		return "info"
+	case 3:
+		return "debug"
+	case 4:
+		return "verbose"
+	default:
+		return fmt.Sprintf("%d", level)
+	}
+}
@@ -0,0 +1,103 @@
+/*
+ * Copyright (c) 2022 Deomid "rojer" Ryabkov
+ * All rights reserved
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package logline
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	id50 := strings.Repeat("a", MaxDeviceIDLen)
+	for _, tc := range []struct {
+		line   string
+		want   *LineInfo
+		reason string
+	}{
+		{line: "esp32_123456 7 12.345 1 2|hello world", want: &LineInfo{DeviceID: "esp32_123456", SeqNum: 7, UptimeMs: 12345, FD: 1, Level: 2, Msg: "hello world"}},
+		{line: "dev 1 0 2 0|", want: &LineInfo{DeviceID: "dev", SeqNum: 1, FD: 2, Msg: ""}},
+		{line: "dev 1 1 1 3|a|b", want: &LineInfo{DeviceID: "dev", SeqNum: 1, UptimeMs: 1000, FD: 1, Level: 3, Msg: "a|b"}},
+		{line: "dev  1 1 1 2 |repeated delimiters", want: &LineInfo{DeviceID: "dev", SeqNum: 1, UptimeMs: 1000, FD: 1, Level: 2, Msg: "repeated delimiters"}},
+		{line: id50 + " 1 1 1 2|max id", want: &LineInfo{DeviceID: id50, SeqNum: 1, UptimeMs: 1000, FD: 1, Level: 2, Msg: "max id"}},
+		{line: "dev 1 1 1 2 no delimiter", reason: "no_delimiter"},
+		{line: "dev 1 1 1|too few", reason: "num_parts"},
+		{line: "dev 1 1 1 2 3|too many", reason: "num_parts"},
+		{line: "dev x 1 1 2|bad seq", reason: "bad_seqnum"},
+		{line: "dev 1 x 1 2|bad uptime", reason: "bad_uptime"},
+		{line: "dev 1 1 -1 2|bad fd", reason: "bad_fd"},
+		{line: "dev 1 1 1 E|bad level", reason: "bad_level"},
+		{line: " 1 1 1 2|empty id", reason: "device_id_empty"},
+		{line: id50 + "a 1 1 1 2|long id", reason: "device_id_too_long"},
+		{line: "de\x01v 1 1 1 2|control chars", reason: "device_id_bad_chars"},
+		{line: "dev 1 " + strings.Repeat("1", MaxTokenLen+1) + " 1 2|long token", reason: "token_too_long"},
+		{line: strings.Repeat("a ", MaxHeaderLen) + "|long header", reason: "header_too_long"},
+	} {
+		li, err := Parse([]byte(tc.line))
+		checkParse(t, tc.line, li, err, tc.want, tc.reason)
+	}
+}
+
+func TestFormatParse(t *testing.T) {
+	for _, tc := range []struct {
+		fieldDelim, msgDelim string
+		line                 string
+		want                 *LineInfo
+		reason               string
+	}{
+		{fieldDelim: "\t", msgDelim: "|", line: "dev\t1\t2.5\t1\t3|tab delimited", want: &LineInfo{DeviceID: "dev", SeqNum: 1, UptimeMs: 2500, FD: 1, Level: 3, Msg: "tab delimited"}},
+		{fieldDelim: "\t", msgDelim: "|", line: "dev\t1\t2.5\t1\t3\t|trailing tab", want: &LineInfo{DeviceID: "dev", SeqNum: 1, UptimeMs: 2500, FD: 1, Level: 3, Msg: "trailing tab"}},
+		{fieldDelim: "\t", msgDelim: "|", line: "my dev\t1\t2\t1\t3|spaces in id", want: &LineInfo{DeviceID: "my dev", SeqNum: 1, UptimeMs: 2000, FD: 1, Level: 3, Msg: "spaces in id"}},
+		{fieldDelim: "\t", msgDelim: "|", line: "dev 1 2 1 3|space delimited", reason: "num_parts"},
+		{fieldDelim: ";", msgDelim: ">", line: "dev;1;2;1;0>semicolons | and pipes", want: &LineInfo{DeviceID: "dev", SeqNum: 1, UptimeMs: 2000, FD: 1, Msg: "semicolons | and pipes"}},
+		{fieldDelim: ";", msgDelim: ">", line: "dev;1;2;1;0|wrong delimiter", reason: "no_delimiter"},
+	} {
+		f, err := NewFormat(tc.fieldDelim, tc.msgDelim)
+		if err != nil {
+			t.Fatalf("NewFormat(%q, %q): %v", tc.fieldDelim, tc.msgDelim, err)
+		}
+		li, err := f.Parse([]byte(tc.line))
+		checkParse(t, tc.line, li, err, tc.want, tc.reason)
+	}
+}
+
+func TestNewFormatErrors(t *testing.T) {
+	for _, tc := range [][2]string{{"", "|"}, {" ", ""}, {"ab", "|"}, {" ", "||"}, {"|", "|"}} {
+		if _, err := NewFormat(tc[0], tc[1]); err == nil {
+			t.Errorf("NewFormat(%q, %q): expected an error", tc[0], tc[1])
+		}
+	}
+}
+
+// checkParse compares the result of parsing the line with the expected line or error reason.
+func checkParse(t *testing.T, line string, li *LineInfo, err error, want *LineInfo, reason string) {
+	t.Helper()
+	if reason != "" {
+		if pe, ok := err.(*Error); !ok || pe.Reason != reason {
+			t.Errorf("Parse(%q): got %v, %v; want error %s", line, li, err, reason)
+		}
+		return
+	}
+	if err != nil {
+		t.Errorf("Parse(%q): unexpected error: %v", line, err)
+		return
+	}
+	if li.DeviceID != want.DeviceID || li.SeqNum != want.SeqNum || li.UptimeMs != want.UptimeMs ||
+		li.FD != want.FD || li.Level != want.Level || li.Msg != want.Msg {
+		t.Errorf("Parse(%q): got %+v, want %+v", line, li, want)
+	}
+}
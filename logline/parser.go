@@ -0,0 +1,81 @@
+/*
+ * Copyright (c) 2022 Deomid "rojer" Ryabkov
+ * All rights reserved
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package logline
+
+import (
+	"sort"
+	"sync"
+)
+
+// Parser parses a single line, without the trailing newline.
+// Errors should be of type *Error.
+type Parser interface {
+	Parse(line []byte) (*LineInfo, error)
+}
+
+// PacketParser is implemented by parsers of binary formats that need the whole packet
+// instead of newline-separated lines.
+type PacketParser interface {
+	ParsePacket(data []byte) ([]*LineInfo, error)
+}
+
+// ParserFunc adapts an ordinary function to the Parser interface.
+type ParserFunc func(line []byte) (*LineInfo, error)
+
+func (f ParserFunc) Parse(line []byte) (*LineInfo, error) {
+	return f(line)
+}
+
+var (
+	parsersMu sync.RWMutex
+	parsers   = map[string]Parser{
+		"mos":        DefaultFormat,
+		"json":       ParserFunc(ParseJSON),
+		"cbor":       CBOR,
+		"esp-idf":    ParserFunc(ParseESPIDF),
+		"syslog5424": ParserFunc(ParseSyslog5424),
+		"syslog3164": ParserFunc(ParseSyslog3164),
+	}
+)
+
+// RegisterParser makes a parser available by name, replacing the existing one, if any.
+func RegisterParser(name string, p Parser) {
+	parsersMu.Lock()
+	defer parsersMu.Unlock()
+	parsers[name] = p
+}
+
+// LookupParser returns the parser registered with the name.
+func LookupParser(name string) (Parser, bool) {
+	parsersMu.RLock()
+	defer parsersMu.RUnlock()
+	p, ok := parsers[name]
+	return p, ok
+}
+
+// ParserNames returns names of the registered parsers, sorted.
+func ParserNames() []string {
+	parsersMu.RLock()
+	defer parsersMu.RUnlock()
+	var res []string
+	for name := range parsers {
+		res = append(res, name)
+	}
+	sort.Strings(res)
+	return res
+}
@@ -0,0 +1,105 @@
+/*
+ * Copyright (c) 2022 Deomid "rojer" Ryabkov
+ * All rights reserved
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package logline
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+// RegexParser parses lines with a user-supplied regular expression.
+// Named groups deviceid and msg are required, seq, uptime (seconds), fd and level are optional.
+// Other named groups are stored in Fields.
+type RegexParser struct {
+	re *regexp.Regexp
+}
+
+// NewRegexParser compiles the expression and checks that it has the required groups.
+func NewRegexParser(expr string) (*RegexParser, error) {
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]bool)
+	for _, name := range re.SubexpNames() {
+		names[name] = true
+	}
+	for _, name := range []string{"deviceid", "msg"} {
+		if !names[name] {
+			return nil, fmt.Errorf("named group (?P<%s>...) is required", name)
+		}
+	}
+	return &RegexParser{re: re}, nil
+}
+
+func (rp *RegexParser) Parse(line []byte) (*LineInfo, error) {
+	m := rp.re.FindSubmatchIndex(line)
+	if m == nil {
+		return nil, newError("no_match", "line does not match the regex")
+	}
+	var li LineInfo
+	for i, name := range rp.re.SubexpNames() {
+		if name == "" || m[2*i] < 0 {
+			continue
+		}
+		v := line[m[2*i]:m[2*i+1]]
+		switch name {
+		case "deviceid":
+			if err := checkDeviceID(v); err != nil {
+				return nil, err
+			}
+			li.DeviceID = string(v)
+		case "seq":
+			n, err := strconv.ParseUint(string(v), 10, 64)
+			if err != nil {
+				return nil, newError("bad_seqnum", "invalid seqnum %s", quote(v))
+			}
+			li.SeqNum = n
+		case "uptime":
+			f, err := strconv.ParseFloat(string(v), 64)
+			if err != nil || f < 0 {
+				return nil, newError("bad_uptime", "invalid uptime %s", quote(v))
+			}
+			li.UptimeMs = uint64(f * 1000)
+		case "fd":
+			n, err := strconv.ParseUint(string(v), 10, 32)
+			if err != nil {
+				return nil, newError("bad_fd", "invalid fd %s", quote(v))
+			}
+			li.FD = uint(n)
+		case "level":
+			l, ok := ParseLevel(string(v))
+			if !ok {
+				return nil, newError("bad_level", "invalid level %s", quote(v))
+			}
+			li.Level = l
+		case "msg":
+			li.Msg = string(v)
+		default:
+			if li.Fields == nil {
+				li.Fields = make(map[string]string)
+			}
+			li.Fields[name] = string(v)
+		}
+	}
+	if li.DeviceID == "" {
+		return nil, newError("device_id_empty", "empty device id")
+	}
+	return &li, nil
+}
@@ -0,0 +1,96 @@
+/*
+ * Copyright (c) 2022 Deomid "rojer" Ryabkov
+ * All rights reserved
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package logline
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ParseSyslog3164 parses a BSD syslog (RFC 3164) message:
+//
+//	<PRI>Mmm dd hh:mm:ss HOSTNAME TAG[PID]: MSG
+//
+// Hostname becomes the device ID and severity is mapped to level. The message is kept
+// as is, including the tag, which is also stored in Fields as "app" (and "procid").
+// Timestamp is optional and may also be in RFC 3339 format. It has no year,
+// the current one is assumed unless that puts it in the future.
+func ParseSyslog3164(line []byte) (*LineInfo, error) {
+	return parseSyslog3164(line, time.Now())
+}
+
+func parseSyslog3164(line []byte, now time.Time) (*LineInfo, error) {
+	pri, rest, err := parsePRI(line)
+	if err != nil {
+		return nil, err
+	}
+	var li LineInfo
+	li.Level = syslogSeverityToLevel(pri % 8)
+	li.Fields = map[string]string{"facility": strconv.Itoa(pri / 8)}
+	li.Time, rest = parse3164Timestamp(rest, now)
+	rest = bytes.TrimLeft(rest, " ")
+	host, msg, _ := bytes.Cut(rest, []byte(" "))
+	// Without a host name, the first word is the tag.
+	if len(host) == 0 || bytes.ContainsAny(host, ":[") {
+		return nil, newError("device_id_empty", "missing host name")
+	}
+	if err := checkDeviceID(host); err != nil {
+		return nil, err
+	}
+	li.DeviceID = string(host)
+	li.Msg = string(msg)
+	if tag, _, found := strings.Cut(li.Msg, ":"); found && !strings.Contains(tag, " ") {
+		if app, pid, found := strings.Cut(tag, "["); found {
+			li.Fields["app"] = app
+			li.Fields["procid"] = strings.TrimSuffix(pid, "]")
+		} else {
+			li.Fields["app"] = tag
+		}
+	}
+	return &li, nil
+}
+
+// parse3164Timestamp parses the timestamp, if present, and returns the remainder.
+func parse3164Timestamp(b []byte, now time.Time) (time.Time, []byte) {
+	first, rest, _ := bytes.Cut(b, []byte(" "))
+	if t, err := time.Parse(time.RFC3339Nano, string(first)); err == nil {
+		return t, rest
+	}
+	// "Jan _2 15:04:05", optionally with fractional seconds.
+	if len(b) < len(time.Stamp) {
+		return time.Time{}, b
+	}
+	n := len(time.Stamp)
+	if len(b) > n && b[n] == '.' {
+		n++
+		for n < len(b) && b[n] >= '0' && b[n] <= '9' {
+			n++
+		}
+	}
+	t, err := time.ParseInLocation(time.Stamp, string(b[:n]), now.Location())
+	if err != nil {
+		return time.Time{}, b
+	}
+	t = t.AddDate(now.Year(), 0, 0)
+	if t.After(now.AddDate(0, 1, 0)) {
+		t = t.AddDate(-1, 0, 0)
+	}
+	return t, b[n:]
+}
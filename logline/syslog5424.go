@@ -0,0 +1,165 @@
+/*
+ * Copyright (c) 2022 Deomid "rojer" Ryabkov
+ * All rights reserved
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package logline
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const nilValue = "-"
+
+// ParseSyslog5424 parses an RFC 5424 syslog message:
+//
+//	<PRI>1 TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA MSG
+//
+// Hostname becomes the device ID and severity is mapped to level.
+// App name, process and message ids are stored in Fields as "app", "procid" and "msgid",
+// structured data parameters as "SD-ID.PARAM". Sequence number and uptime are taken
+// from the "meta" SD element, if present.
+func ParseSyslog5424(line []byte) (*LineInfo, error) {
+	pri, rest, err := parsePRI(line)
+	if err != nil {
+		return nil, err
+	}
+	var li LineInfo
+	li.Level = syslogSeverityToLevel(pri % 8)
+	li.Fields = map[string]string{"facility": strconv.Itoa(pri / 8)}
+	var hdr [6]string
+	for i := range hdr {
+		var f []byte
+		f, rest, _ = bytes.Cut(rest, []byte(" "))
+		if len(f) == 0 {
+			return nil, newError("num_parts", "syslog header is too short")
+		}
+		hdr[i] = string(f)
+	}
+	if hdr[0] != "1" {
+		return nil, newError("bad_version", "unsupported syslog version %s", quote([]byte(hdr[0])))
+	}
+	if hdr[1] != nilValue {
+		if li.Time, err = time.Parse(time.RFC3339Nano, hdr[1]); err != nil {
+			return nil, newError("bad_timestamp", "invalid timestamp %s", quote([]byte(hdr[1])))
+		}
+	}
+	if hdr[2] == nilValue {
+		return nil, newError("device_id_empty", "empty host name")
+	}
+	if err := checkDeviceID([]byte(hdr[2])); err != nil {
+		return nil, err
+	}
+	li.DeviceID = hdr[2]
+	for i, name := range []string{"app", "procid", "msgid"} {
+		if v := hdr[3+i]; v != nilValue {
+			li.Fields[name] = v
+		}
+	}
+	if rest, err = parseSD(rest, li.Fields); err != nil {
+		return nil, err
+	}
+	if v, err := strconv.ParseUint(li.Fields["meta.sequenceId"], 10, 64); err == nil {
+		li.SeqNum = v
+	}
+	// sysUpTime is in hundredths of a second.
+	if v, err := strconv.ParseUint(li.Fields["meta.sysUpTime"], 10, 64); err == nil {
+		li.UptimeMs = v * 10
+	}
+	if len(rest) > 0 && rest[0] == ' ' {
+		rest = rest[1:]
+	}
+	li.Msg = string(bytes.TrimPrefix(rest, []byte("\xef\xbb\xbf")))
+	return &li, nil
+}
+
+// parsePRI parses the <PRI> part and returns the priority and the remainder of the line.
+func parsePRI(line []byte) (int, []byte, error) {
+	if len(line) == 0 || line[0] != '<' {
+		return 0, nil, newError("bad_pri", "missing priority")
+	}
+	end := bytes.IndexByte(line, '>')
+	if end < 2 || end > 4 {
+		return 0, nil, newError("bad_pri", "invalid priority")
+	}
+	pri, err := strconv.Atoi(string(line[1:end]))
+	if err != nil || pri > 191 {
+		return 0, nil, newError("bad_pri", "invalid priority %s", quote(line[1:end]))
+	}
+	return pri, line[end+1:], nil
+}
+
+// syslogSeverityToLevel maps syslog severity to Mongoose OS log level.
+func syslogSeverityToLevel(sev int) uint {
+	switch {
+	case sev <= 3: // Emergency, alert, critical, error.
+		return 0
+	case sev == 4: // Warning.
+		return 1
+	case sev <= 6: // Notice, informational.
+		return 2
+	default: // Debug.
+		return 3
+	}
+}
+
+// parseSD parses structured data elements into fields, returns the remainder of the line.
+func parseSD(b []byte, fields map[string]string) ([]byte, error) {
+	if bytes.HasPrefix(b, []byte(nilValue)) {
+		return b[1:], nil
+	}
+	for len(b) > 0 && b[0] == '[' {
+		end := bytes.IndexAny(b, " ]")
+		if end < 0 {
+			return nil, newError("bad_sd", "unterminated structured data")
+		}
+		id := string(b[1:end])
+		b = b[end:]
+		for len(b) > 0 && b[0] == ' ' {
+			b = b[1:]
+			eq := bytes.IndexByte(b, '=')
+			if eq < 1 || len(b) < eq+2 || b[eq+1] != '"' {
+				return nil, newError("bad_sd", "invalid structured data parameter in %s", quote([]byte(id)))
+			}
+			name := string(b[:eq])
+			b = b[eq+2:]
+			var val strings.Builder
+			for {
+				if len(b) == 0 {
+					return nil, newError("bad_sd", "unterminated structured data value in %s", quote([]byte(id)))
+				}
+				c := b[0]
+				b = b[1:]
+				if c == '"' {
+					break
+				}
+				if c == '\\' && len(b) > 0 && (b[0] == '"' || b[0] == '\\' || b[0] == ']') {
+					c = b[0]
+					b = b[1:]
+				}
+				val.WriteByte(c)
+			}
+			fields[id+"."+name] = val.String()
+		}
+		if len(b) == 0 || b[0] != ']' {
+			return nil, newError("bad_sd", "unterminated structured data element %s", quote([]byte(id)))
+		}
+		b = b[1:]
+	}
+	return b, nil
+}
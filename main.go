@@ -18,202 +18,1117 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	stdFlag "flag"
 	"fmt"
 	"net"
+	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
+	"regexp"
 	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"text/template"
 	"time"
+	"unicode/utf8"
 
 	"github.com/juju/errors"
+	"github.com/rojer/mos_udp_log_catcher/logline"
 	flag "github.com/spf13/pflag"
 	klog "k8s.io/klog/v2"
 )
 
 var (
-	flagListenAddr   = flag.String("listen-addr", "", "Address to listen on; udp://:port/ or udp://addr:port/")
+	flagConfig       = flag.String("config", "", "Read settings from this file, one name = value per line; format, template and filter settings are reloaded on SIGHUP")
+	flagListenAddr   = flag.StringSlice("listen-addr", nil, "Address(es) to listen on; udp://:port/, udp://addr:port/, udp6://[addr]:port/, addr:port, :port, tcp://addr:port/ for newline-delimited lines over TCP, tls://addr:port/ for TCP with TLS (add ?proxy=1 to expect PROXY protocol v1/v2 headers on tcp:// and tls://), dtls://addr:port/ for DTLS with pre-shared keys, unixgram:///path for a Unix datagram socket, systemd:// or systemd://name for sockets passed by systemd socket activation, coap://addr[:port]/ for CoAP POST or PUT to /log (default port 5683) or stdin:// for lines on standard input (on its own, same as --stdin). Lines are tagged with the address (.Listener), add ?tag=name to override. Can be repeated or comma-separated")
+	flagMcastIface   = flag.String("multicast-iface", "", "Interface to join multicast groups on when listening on a multicast address, e.g. udp6://[ff02::1234]:1514/")
+	flagMQTTBroker   = flag.String("mqtt-broker", "", "Also receive log lines from this MQTT broker, tcp://[user:pass@]host:port or ssl://...")
+	flagMQTTTopic    = flag.String("mqtt-topic", "devices/+/log", "MQTT topic to subscribe to for --mqtt-broker")
+	flagMQTTClientID = flag.String("mqtt-client-id", "", "Client ID to use for --mqtt-broker, default is generated from the host name and random bytes")
+	flagDiscPort     = flag.Int("discovery-port", 0, "If set, answer discovery probes sent to this UDP port (e.g. broadcast by devices on boot) with the address to send logs to")
+	flagDiscProbe    = flag.String("discovery-probe", "WHERE_IS_LOG_CATCHER", "Payload of discovery probes")
+	flagDiscReply    = flag.String("discovery-reply", "", "Reply to discovery probes, default is udp://ip:port/ with the first UDP --listen-addr port and the local address facing the device")
+	flagSerial       = flag.String("serial", "", "Also read console output from this serial port, /dev/ttyUSB0:115200; lines are logged as info messages from --serial-device-id")
+	flagSerialDevID  = flag.String("serial-device-id", "", "Device ID for lines read from --serial, default is the port name, e.g. ttyUSB0")
+	flagTLSCert      = flag.String("tls-cert", "", "Certificate file for tls:// listeners")
+	flagTLSKey       = flag.String("tls-key", "", "Private key file for tls:// listeners")
+	flagDTLSPSKFile  = flag.String("dtls-psk-file", "", "File with pre-shared keys for dtls:// listeners, \"identity hex_key\" per line")
 	flagTimestamp    = flag.String("timestamp-format", "StampMilli", "Format of the timestamp, see https://pkg.go.dev/time#pkg-constants")
+	flagColor        = flag.String("color", "auto", "Color stdout records by level: auto (if stdout is a terminal), always or never")
+	flagHTTPAddr     = flag.String("http-addr", "", "Address of the HTTP server providing /tail?device=ID&n=100[&follow=1], /debug/vars, /ingest (POST input) and /ingest/ws (WebSocket input), e.g. :8080")
+	flagTailBuffer   = flag.Int("tail-buffer", 1000, "Number of recent lines of each device kept for /tail")
+	flagStatsIntvl   = flag.Duration("stats-interval", 0, "If set, log packet and line statistics at this interval")
+	flagInputFormat  = flag.String("input-format", "mos", "Format of incoming lines: mos (Mongoose OS UDP log), syslog5424 (RFC 5424), syslog3164 (BSD syslog), json (one object per line, unknown members go to .Fields), cbor (binary [id, seq, uptime, fd, level, msg] arrays or maps with these keys, one or more per packet), esp-idf (E (12345) tag: message; tag goes to .Fields, source IP is the device id) or regex (see --line-regex); for syslog, host name is used as device id (alias: --parser)")
+	flagDevParser    = flag.StringSlice("device-parser", nil, "Use a different input format for some devices, selector=format; selector is an IP address, a subnet (e.g. 10.0.1.0/24=json) or a device ID glob pattern (e.g. esp32-*=json, the line is parsed with this format and it is used if the device ID matches). Other lines use --input-format. Can be repeated")
+	flagLogfmt       = flag.Bool("extract-logfmt", false, "Extract key=value pairs from messages into .Fields, values with spaces can be quoted: err=\"timed out\"")
+	flagSrcDevID     = flag.Bool("src-device-id", false, "Accept lines with empty or invalid device id and use the source IP address as the device id instead")
+	flagLenient      = flag.Bool("lenient", false, "Log lines that cannot be parsed as is, as info messages with the source IP address as device id and the reason in .Fields \"parse_error\"")
+	flagInvalidUTF8  = flag.String("invalid-utf8", "keep", "What to do with invalid UTF-8 in messages: keep, replace (with U+FFFD) or escape (as \\xNN)")
+	flagMaxMsgLen    = flag.Int("max-msg-len", 0, "Truncate messages longer than this many bytes, a marker with the number of bytes removed is appended; 0 = no limit")
+	flagStripANSI    = flag.Bool("strip-ansi", false, "Remove ANSI escape sequences (e.g. colors) from messages")
+	flagKeepANSIOut  = flag.Bool("strip-ansi-keep-stdout", false, "With --strip-ansi, only strip escape sequences from files and keep them on stdout")
+	flagLineRegex    = flag.String("line-regex", "", "Parse lines with this regular expression, implies --input-format=regex. Named groups: deviceid and msg (required), seq, uptime (seconds), fd, level (number or name, e.g. E, warn); other named groups go to .Fields")
+	flagFieldDelim   = flag.String("field-delimiter", " ", "Delimiter of the line header fields (alias: --field-delim)")
+	flagMsgDelim     = flag.String("msg-delimiter", "|", "Delimiter between the line header and the message (alias: --msg-delim)")
+	flagJoinCont     = flag.Bool("join-continuations", false, "Append lines without a valid header to the message of the preceding line from the same packet (or replay file)")
+	flagSafeChars    = flag.String("safe-chars", "", "Characters allowed in file names in addition to letters, digits and \"-_., \"")
+	flagReplChar     = flag.String("replacement-char", "_", "Character that replaces unsafe characters in file names")
+	flagSinks        = flag.StringSlice("sink", nil, "Additional output for lines: stdout:, file:///path, udp://host:port or tcp://host:port; parameters: format (template, json or logfmt, --stdout-format by default), min-level, allow-devices and deny-devices (glob patterns separated by commas), e.g. tcp://collector:5000?min-level=1. Can be repeated")
+	flagMirrorTo     = flag.StringSlice("mirror-to", nil, "Re-send every received datagram verbatim to this address, udp://host:port/. Can be repeated")
+	flagHMACKey      = flag.String("hmac-key", "", "If set, lines must be signed with HMAC-SHA256 using this key: ...|message|hex_hmac. Lines that fail verification are dropped")
+	flagHMACKeyFile  = flag.String("hmac-key-file", "", "File with per-device HMAC keys, \"device_id key\" per line. Devices not listed use --hmac-key")
+	flagHMACMode     = flag.String("hmac-mode", "line", "What is signed with --hmac-key: line (...|message|hex_hmac) or packet (each datagram or message ends with a \"#hmac device_id hex_hmac\" line and only contains lines from that device; on tcp://, tls://, stdin and POST /ingest each block of lines up to the trailer is a packet)")
+	flagDevKeysFile  = flag.String("device-keys-file", "", "File with per-device AES keys for encrypted packets, \"device_id hex_key\" per line. Plain text lines from the listed devices are dropped")
+	flagStdin        = flag.Bool("stdin", false, "Instead of listening, process log lines from standard input and exit at EOF")
+	flagErrorFile    = flag.String("error-file", "", "If set, lines that could not be parsed are recorded in this file along with the source address and the reason")
+	flagQuarantine   = flag.String("quarantine-dir", "", "If set, lines and packets that could not be parsed are hex-dumped to quarantine-YYYYMMDD.log files in this directory along with the source address and the reason")
+	flagErrorRate    = flag.Int("error-file-rate", 10, "Maximum number of lines per second recorded in --error-file or --quarantine-dir, 0 = unlimited")
+	flagReplayFile   = flag.String("replay-file", "", "Instead of listening, process log lines from this file and exit")
+	flagPcapFile     = flag.String("pcap-file", "", "Instead of listening, process UDP payloads from this pcap capture with their capture timestamps and exit")
+	flagPcapPort     = flag.Int("pcap-port", 0, "Only use packets sent to this port from --pcap-file, 0 = all")
 	flagStdout       = flag.Bool("stdout", false, "Log incoming messages to stdout")
-	flagStdoutFormat = flag.String("stdout-format", "{{.TimestampStr}} {{.DeviceID}} {{.Src}} {{.LevelChar}} {{.Msg}}", "Format of stdout records")
+	flagStdoutFormat = flag.String("stdout-format", "{{.TimestampStr}} {{.DeviceID}} {{.Src}} {{.LevelChar}} {{.Msg}}", "Format of stdout records, json for one JSON object per line or logfmt for key=value pairs"+tmplFieldsHelp)
 	flagLogDir       = flag.String("log-dir", "", "Log incoming messages to per-device files in this directory")
-	flagFileFormat   = flag.String("file-format", "{{.TimestampStr}} {{.Src}} {{.LevelChar}} {{.Msg}}", "Format of file records")
+	flagRecordSep    = flag.String("record-separator", `\n`, "Separator written after each record on stdout and in files, escapes such as \\n, \\r\\n and \\0 are interpreted")
+	flagFileFormat   = flag.String("file-format", "{{.TimestampStr}} {{.Src}} {{.LevelChar}} {{.Msg}}", "Format of file records, json for one JSON object per line or logfmt for key=value pairs"+tmplFieldsHelp)
+	flagFDNames      = flag.StringSlice("fd-names", nil, "Names of device output streams as fd:name or fd=name, e.g. 1:stdout,2:stderr")
+	flagLevelMap     = flag.StringToString("level-map", nil, "Characters and names of levels (.LevelChar and .LevelName), e.g. 0=F:fatal,1=E:error; levels that are not listed use the default E/error, W/warning, I/info, D/debug, V/verbose")
+	flagSplitByFD    = flag.Bool("split-by-fd", false, "Write each device output stream to a separate file")
+	flagNameIncSrc   = flag.Bool("filename-include-src", false, "Include source IP address in the default file names, so devices with the same ID from different addresses are logged separately")
+	flagFlatLayout   = flag.Bool("flat-layout", false, "Put all the files directly in --log-dir, named <device>.<date>.log (and <device>.latest.log), instead of per-device subdirectories. Cannot be used with --file-name-template")
+	flagFileNameTmpl = flag.String("file-name-template", "", "Template for log file names, relative to --log-dir (default "+deviceLogName+")")
+	flagCombinedFile = flag.String("combined-file", "", "If set, all the records are also written to this file, prefixed with device id. Relative to --log-dir, can be a template, e.g. all.{{.Year}}{{.Month}}{{.Day}}.log")
+	flagLatestTmpl   = flag.String("latest-name-template", "", "Template for the name of the symlink to the latest log file of a device, relative to --log-dir (default "+latestDeviceLogName+", or "+latestDeviceFDLogName+" if streams are written to separate files)")
+	flagRetention    = flag.Duration("retention", 0, "Remove log files older than this, e.g. 720h")
+	flagFlushIntvl   = flag.Duration("flush-interval", 0, "Buffer file writes and flush them at this interval, 0 to write every record immediately")
+	flagFlushOnError = flag.Bool("flush-on-error", true, "With --flush-interval, write out error records immediately")
+	flagSplitConfl   = flag.Bool("split-conflicting-devices", false, "If the same device ID is used from different addresses, write to separate files with address suffix")
+	flagMaxOpenFiles = flag.Int("max-open-files", 0, "Maximum number of open log files, least recently used ones are closed when the limit is reached. 0 = no limit")
+	flagOfflineTmout = flag.Duration("offline-timeout", 0, "If set, log device online/offline events, a device is considered offline after this long without lines")
+	flagFsync        = flag.Bool("fsync", false, "Sync log files to disk every time data is written out")
+	flagFileMode     = flag.String("file-mode", "0644", "Permissions of the log files, octal")
+	flagDirMode      = flag.String("dir-mode", "0755", "Permissions of the log directories, octal")
+	flagFileEncoding = flag.String("file-encoding", "utf-8", "Character encoding of the log files, e.g. windows-1252")
+	flagContRegex    = flag.String("continuation-regex", "", `Messages matching this regular expression (e.g. "^\s|^Backtrace:") are appended to the preceding line from the same device and stream, e.g. to keep backtraces together. Lines are held until the next line from the device or --continuation-timeout`)
+	flagContTimeout  = flag.Duration("continuation-timeout", time.Second, "With --continuation-regex, emit lines if no continuation arrives within this time")
+	flagRecordStart  = flag.String("record-start", "", "Marker that starts a multi-line record, lines up to --record-end are joined into one record")
+	flagRecordEnd    = flag.String("record-end", "", "Marker that ends a multi-line record")
+	flagRecordMax    = flag.Int("record-max-lines", 1000, "Maximum number of lines in a multi-line record")
+	flagRecordTO     = flag.Duration("record-timeout", 5*time.Second, "Emit unterminated multi-line records after this time")
+	flagPayloadComp  = flag.String("payload-compression", "none", "Compression of datagram payloads: none, gzip, zlib, deflate (raw) or auto (gzip and zlib are detected, other payloads are used as is)")
+	flagRcvBuf       = flag.Int("rcvbuf", 0, "Receive buffer size of datagram sockets (SO_RCVBUF), 0 to use the system default (alias: --recv-buffer-bytes)")
+	flagRecvBatch    = flag.Int("recv-batch", 16, "Maximum number of datagrams to read with one system call (recvmmsg, Linux only), 1 to read one at a time")
+	flagReceivers    = flag.Int("receivers", 1, "Number of sockets to receive on, using SO_REUSEPORT, each with its own reader (alias: --listeners)")
+	flagWorkers      = flag.Int("workers", 1, "Number of packet processing workers")
+	flagQueueSize    = flag.Int("queue-size", 1000, "Size of the packet queue of each worker, packets are dropped when it is full")
+	flagMaxPktSize   = flag.Int("max-packet-size", 1500, "Maximum size of an incoming datagram, this is the size of receive buffers; larger datagrams are truncated")
+	flagMaxPayload   = flag.Int("max-payload-size", 64*1024, "Maximum size of a packet after decompression and decryption, larger ones are dropped; 0 = no limit")
+	flagMaxPktLines  = flag.Int("max-packet-lines", 1000, "Maximum number of lines processed from a single packet, the rest are dropped; 0 = no limit")
+	flagAllowNUL     = flag.Bool("allow-nul", false, "Accept lines that contain NUL bytes, by default they are rejected as malformed")
+	flagFragMaxSize  = flag.Int("fragment-max-size", 4096, "Maximum size of a partial line held until the rest of it arrives in the next packet")
+	flagFragTimeout  = flag.Duration("fragment-timeout", 5*time.Second, "Drop partial lines if the rest does not arrive within this time")
+	flagMsgTimeFmt   = flag.String("msg-time-format", "", "Format of the timestamp some devices put at the start of messages (e.g. RFC3339 or \"2006-01-02 15:04:05.000\", see --timestamp-format), it is parsed into .DeviceTime and .DeviceTimeStr and removed from the message; UTC is assumed if there is no time zone")
+	flagKeepMsgTime  = flag.Bool("msg-time-keep", false, "Keep the timestamp parsed with --msg-time-format in the message")
+	flagUptimeDelta  = flag.Bool("use-uptime-delta", false, "Compute device time (.DeviceTime, .DeviceTimeStr) from the time of the first message and device uptime")
+	flagResolveSrc   = flag.Bool("resolve-src", false, "Resolve source addresses to host names (.SrcHost)")
+	flagResolveTTL   = flag.Duration("resolve-ttl", 10*time.Minute, "How long to cache source host names for")
+	flagReorderWin   = flag.Duration("reorder-window", 0, "Hold lines for this long to write them in sequence number order, 0 to disable")
+	flagDedupWindow  = flag.Int("dedup-window", 0, "Number of recent lines of each device remembered to skip retransmitted duplicates, 0 to disable")
+	flagReorderMax   = flag.Int("reorder-max-lines", 1000, "Maximum number of lines held for reordering per device")
+	flagMinLevel     = flag.Int("min-level", -1, "Drop lines with level above this (0=E, 1=W, 2=I, 3=D, 4=V), -1 to keep all")
+	flagMinUptime    = flag.Duration("min-uptime", 0, "Drop lines logged by devices before reaching this uptime")
+	flagMaxRate      = flag.Float64("max-lines-per-sec", 0, "Limit the rate of lines from each device, excess lines are dropped; 0 = no limit")
+	flagRateExempt   = flag.Int("rate-limit-exempt-level", 1, "Lines with this level or below are never dropped by the rate limiter")
+	flagAllowDevices = flag.StringSlice("allow-devices", nil, "Only process devices with IDs matching these glob patterns")
+	flagDenyDevices  = flag.StringSlice("deny-devices", nil, "Do not process devices with IDs matching these glob patterns, takes precedence over --allow-devices")
+	flagAllowStreams = flag.StringSlice("allow-streams", nil, "Only process lines from streams with names (see --fd-names) matching these glob patterns")
+	flagDenyStreams  = flag.StringSlice("deny-streams", nil, "Do not process lines from streams with names matching these glob patterns, takes precedence over --allow-streams")
 )
 
+const tmplFieldsHelp = "; fields: .TimestampStr, .UnixMillis, .UnixNanos, .DeviceID, .Src, .SeqNum, .FD, .FDName, " +
+	".SrcHost, .SrcSafe, .Listener, .Level, .LevelChar, .LevelName, .Uptime (1h02m03.456s), .UptimeMs, .DeviceTimeStr, .Msg, .Fields (format-specific, e.g. index .Fields \"app\"), .Year, .Month, .Day, .Hour; " +
+	"functions: upper, lower, pad N, trunc N, default, json, logfmt"
+
 // UDP log line format is:
 // device_id seq_no uptime fd level|msg
-// One or more lines per packet. No splitting between packets.
+// One or more lines per packet. Lines are normally not split between packets
+// but if a packet ends with an incomplete line, it is prepended to the next one.
 
 var (
-	safeChars  [256]bool
-	stdoutTmpl *template.Template
-	fileTmpl   *template.Template
+	safeChars       [256]bool
+	recordSep            = "\n"
+	replacementChar byte = '_'
+	fileTmpl        *template.Template
+	recAsm          *RecordAssembler
+	grouper         *LineGrouper
+	reorderer       *Reorderer
+	dedup           *Deduplicator
+	mirror          *Mirror
+	hmacVerifier    *HMACVerifier
+	decryptor       *PayloadDecryptor
+	errFile         *ErrorFile
+	lineFormat      = logline.DefaultFormat
+	inputParser     = logline.Parser(logline.DefaultFormat) // Selected by --input-format.
+	fdNames         map[uint]string
+	levelNames      map[uint]levelName
+	devClock        *DeviceClock
+	stdoutMu        sync.Mutex
+	color           bool
+	tailBuf         *TailBuffer
+	resolver        *SrcResolver
+	rateLimit       *RateLimiter
 )
 
 func UDPLog() error {
-	if *flagListenAddr == "" {
+	var err error
+	if len(*flagListenAddr) == 0 && *flagMQTTBroker == "" && *flagSerial == "" && *flagReplayFile == "" && *flagPcapFile == "" && !*flagStdin {
 		return fmt.Errorf("--listen-addr is required")
 	}
-	purl, err := url.Parse(*flagListenAddr)
-	if err != nil {
-		return errors.Annotatef(err, "invalid --listen-addr")
+	if *flagMaxPktSize < 64 || *flagMaxPktSize > 65535 {
+		return errors.Errorf("--max-packet-size must be between 64 and 65535")
 	}
-	if purl.Scheme != "udp" {
-		return fmt.Errorf("scheme must be udp://")
+	switch *flagPayloadComp {
+	case "none", "gzip", "zlib", "deflate", "auto":
+	default:
+		return errors.Errorf("invalid --payload-compression %q", *flagPayloadComp)
 	}
-	p, err := strconv.Atoi(purl.Port())
-	if err != nil {
-		return errors.Errorf("invalid UDP port format, must be udp://:port/ or udp://ip:port/")
+	switch *flagInvalidUTF8 {
+	case "keep", "replace", "escape":
+	default:
+		return errors.Errorf("invalid --invalid-utf8 %q", *flagInvalidUTF8)
 	}
-	addr := net.UDPAddr{
-		IP:   net.ParseIP(purl.Hostname()),
-		Port: p,
+	if *flagRecvBatch < 1 || *flagRecvBatch > 1024 {
+		return errors.Errorf("--recv-batch must be between 1 and 1024")
 	}
-	udpc, err := net.ListenUDP("udp", &addr)
-	if err != nil {
-		return errors.Annotatef(err, "failed to open listner at %+v", addr)
+	if *flagWorkers < 1 {
+		return errors.Errorf("--workers must be at least 1")
+	}
+	if lineFormat, err = logline.NewFormat(*flagFieldDelim, *flagMsgDelim); err != nil {
+		return errors.Annotatef(err, "invalid --field-delimiter or --msg-delimiter")
+	}
+	lineFormat.DeviceIDOptional = *flagSrcDevID
+	logline.RegisterParser("mos", lineFormat)
+	if *flagLineRegex != "" {
+		rp, err := logline.NewRegexParser(*flagLineRegex)
+		if err != nil {
+			return errors.Annotatef(err, "invalid --line-regex")
+		}
+		logline.RegisterParser("regex", rp)
+		if *flagInputFormat == "mos" {
+			*flagInputFormat = "regex"
+		}
+	}
+	var ok bool
+	if inputParser, ok = logline.LookupParser(*flagInputFormat); !ok {
+		return errors.Errorf("invalid --input-format %q, must be one of: %s", *flagInputFormat, strings.Join(logline.ParserNames(), ", "))
+	}
+	if parserRules, err = newParserRules(*flagDevParser); err != nil {
+		return errors.Annotatef(err, "invalid --device-parser")
+	}
+	if *flagFlatLayout && (*flagFileNameTmpl != "" || *flagLatestTmpl != "") {
+		return errors.Errorf("--flat-layout cannot be used with --file-name-template or --latest-name-template")
+	}
+	if recordSep, err = unescape(*flagRecordSep); err != nil || recordSep == "" {
+		return errors.Errorf("invalid --record-separator %q", *flagRecordSep)
+	}
+	if err := initSafeChars(*flagSafeChars, *flagReplChar); err != nil {
+		return errors.Annotatef(err, "invalid --safe-chars or --replacement-char")
 	}
-	defer udpc.Close()
 	if len(*flagTimestamp) > 0 {
 		tsFormat = ParseTimeStampFormatSpec(*flagTimestamp)
 	}
-	if *flagStdout {
-		if stdoutTmpl, err = template.New("filename").Parse(*flagStdoutFormat); err != nil {
-			return errors.Annotatef(err, "invalid --udp-log-stdout-format template")
+	cfg, err := newDynConfig(currentReloadable())
+	if err != nil {
+		return errors.Trace(err)
+	}
+	dynCfg.Store(cfg)
+	if color, err = useColor(*flagColor, os.Stdout); err != nil {
+		return errors.Trace(err)
+	}
+	if *flagUptimeDelta {
+		devClock = NewDeviceClock()
+	}
+	if *flagMaxRate > 0 {
+		rateLimit = NewRateLimiter(*flagMaxRate, *flagRateExempt)
+	}
+	if *flagResolveSrc {
+		resolver = NewSrcResolver(*flagResolveTTL)
+	}
+	msgTimeFormat = ParseTimeStampFormatSpec(*flagMsgTimeFmt)
+	if fdNames, err = parseFDNames(*flagFDNames); err != nil {
+		return errors.Annotatef(err, "invalid --fd-names")
+	}
+	if levelNames, err = parseLevelMap(*flagLevelMap); err != nil {
+		return errors.Annotatef(err, "invalid --level-map")
+	}
+	if *flagRecordStart != "" || *flagRecordEnd != "" {
+		if *flagRecordStart == "" || *flagRecordEnd == "" {
+			return errors.Errorf("--record-start and --record-end must be specified together")
+		}
+		if *flagRecordTO <= 0 {
+			return errors.Errorf("--record-timeout must be positive")
 		}
+		recAsm = NewRecordAssembler(*flagRecordStart, *flagRecordEnd, *flagRecordMax, *flagRecordTO)
+	}
+	if *flagContRegex != "" {
+		re, err := regexp.Compile(*flagContRegex)
+		if err != nil {
+			return errors.Annotatef(err, "invalid --continuation-regex")
+		}
+		if *flagContTimeout <= 0 {
+			return errors.Errorf("--continuation-timeout must be positive")
+		}
+		grouper = NewLineGrouper(re, *flagRecordMax, *flagContTimeout)
+	}
+	if *flagHMACKey != "" || *flagHMACKeyFile != "" {
+		if hmacVerifier, err = NewHMACVerifier(*flagHMACMode, *flagHMACKey, *flagHMACKeyFile); err != nil {
+			return errors.Annotatef(err, "invalid --hmac-mode or --hmac-key-file")
+		}
+	}
+	if *flagDevKeysFile != "" {
+		if decryptor, err = NewPayloadDecryptor(*flagDevKeysFile); err != nil {
+			return errors.Annotatef(err, "invalid --device-keys-file")
+		}
+	}
+	if *flagDedupWindow > 0 {
+		dedup = NewDeduplicator(*flagDedupWindow)
+	}
+	if *flagReorderWin < 0 || (*flagReorderWin > 0 && *flagReorderWin < time.Millisecond) {
+		return errors.Errorf("--reorder-window must be 0 or at least 1ms")
+	}
+	if *flagReorderWin > 0 {
+		reorderer = NewReorderer(*flagReorderWin, *flagReorderMax)
+	}
+	if *flagErrorFile != "" && *flagQuarantine != "" {
+		return errors.Errorf("--error-file and --quarantine-dir cannot be used together")
+	}
+	if *flagErrorFile != "" || *flagQuarantine != "" {
+		mode, err := parseFileMode(*flagFileMode)
+		if err != nil {
+			return errors.Annotatef(err, "invalid --file-mode")
+		}
+		if *flagErrorFile != "" {
+			errFile, err = NewErrorFile(*flagErrorFile, *flagErrorRate, mode)
+		} else {
+			var dirMode os.FileMode
+			if dirMode, err = parseFileMode(*flagDirMode); err != nil {
+				return errors.Annotatef(err, "invalid --dir-mode")
+			}
+			errFile, err = NewQuarantineDir(*flagQuarantine, *flagErrorRate, mode, dirMode)
+		}
+		if err != nil {
+			return errors.Trace(err)
+		}
+		defer errFile.Close()
+	}
+	if *flagStdout {
+		sinks = append(sinks, &outputSink{Sink: stdoutSink{}, name: "stdout", minLevel: -1, keepANSI: *flagKeepANSIOut})
 	}
 	var fm *FileManager
 	if len(*flagLogDir) > 0 {
-		if fm, err = NewFileManager(*flagLogDir, *flagFileFormat); err != nil {
+		opts := fileManagerOptions()
+		if opts.FileMode, err = parseFileMode(*flagFileMode); err != nil {
+			return errors.Annotatef(err, "invalid --file-mode")
+		}
+		if opts.DirMode, err = parseFileMode(*flagDirMode); err != nil {
+			return errors.Annotatef(err, "invalid --dir-mode")
+		}
+		if fm, err = NewFileManager(*flagLogDir, opts); err != nil {
 			return errors.Trace(err)
 		}
+		sinks = append(sinks, &outputSink{Sink: fm, name: "files", minLevel: -1})
 	}
-	if addr.IP != nil {
-		klog.Infof("Listening on UDP %s:%d...", addr.IP, addr.Port)
-	} else {
-		klog.Infof("Listening on UDP port %d...", addr.Port)
+	if *flagHTTPAddr != "" && *flagTailBuffer > 0 {
+		tailBuf = NewTailBuffer(*flagTailBuffer)
+		sinks = append(sinks, &outputSink{Sink: tailBuf, name: "tail", minLevel: -1})
 	}
-	for {
-		pkt := make([]byte, 1500)
-		n, src, err := udpc.ReadFromUDP(pkt)
+	for _, spec := range *flagSinks {
+		s, err := newOutputSink(spec)
 		if err != nil {
-			return errors.Annotatef(err, "socket read error")
+			return errors.Annotatef(err, "invalid --sink %q", spec)
 		}
-		ts := time.Now()
-		buf := bytes.NewBuffer(pkt[:n])
-		for buf.Len() > 10 {
-			line, _ := buf.ReadBytes('\n')
-			line = bytes.TrimRight(line, "\r\n")
-			if err = processLine(ts, src, line, fm); err != nil {
+		sinks = append(sinks, s)
+	}
+	defer closeSinks()
+	if grouper != nil {
+		go expireGroups()
+	}
+	if recAsm != nil {
+		go expireRecords()
+	}
+	// Make sure buffered data is written out and sockets are cleaned up on termination.
+	go func() {
+		sigCh := make(chan os.Signal, 1)
+		signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+		sig := <-sigCh
+		klog.Infof("Got %s, exiting", sig)
+		flushPending()
+		closeSinks()
+		closeInputs()
+		klog.Flush()
+		os.Exit(0)
+	}()
+	if reorderer != nil {
+		go func() {
+			for now := range time.Tick(*flagReorderWin / 4) {
+				for _, li := range reorderer.Expired(now) {
+					emitLine(li)
+				}
+			}
+		}()
+	}
+	if *flagHTTPAddr != "" {
+		if err := startHTTPServer(*flagHTTPAddr); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if *flagStatsIntvl > 0 {
+		go statsLoop(*flagStatsIntvl)
+	}
+	go reloadOnSIGHUP(fm)
+	if *flagReplayFile != "" {
+		return replayFile(*flagReplayFile)
+	}
+	if *flagPcapFile != "" {
+		return replayPcap(*flagPcapFile, *flagPcapPort)
+	}
+	// stdin:// on its own is the same as --stdin: process the input and exit.
+	if *flagStdin || (len(*flagListenAddr) == 1 && strings.HasPrefix((*flagListenAddr)[0], "stdin://")) {
+		klog.Infof("Reading from stdin...")
+		return replayLines(os.Stdin, "stdin")
+	}
+	if len(*flagMirrorTo) > 0 {
+		if mirror, err = NewMirror(*flagMirrorTo); err != nil {
+			return errors.Annotatef(err, "invalid --mirror-to")
+		}
+	}
+	inputs, err := openInputs(*flagListenAddr)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if *flagMQTTBroker != "" {
+		in, err := newMQTTInput(*flagMQTTBroker, *flagMQTTTopic, *flagMQTTClientID)
+		if err != nil {
+			return errors.Annotatef(err, "invalid --mqtt-broker")
+		}
+		activeInputsMu.Lock()
+		activeInputs = append(activeInputs, in)
+		activeInputsMu.Unlock()
+		inputs = append(inputs, in)
+	}
+	if *flagSerial != "" {
+		in, err := openSerial(*flagSerial, *flagSerialDevID)
+		if err != nil {
+			return errors.Annotatef(err, "invalid --serial")
+		}
+		activeInputsMu.Lock()
+		activeInputs = append(activeInputs, in)
+		activeInputsMu.Unlock()
+		inputs = append(inputs, in)
+	}
+	if *flagDiscPort > 0 {
+		logPort := 0
+		for _, spec := range *flagListenAddr {
+			if _, addr, err := parseListenAddr(spec); err == nil {
+				logPort = addr.Port
+				break
+			}
+		}
+		in, err := newDiscoveryResponder(*flagDiscPort, *flagDiscProbe, *flagDiscReply, logPort)
+		if err != nil {
+			return errors.Annotatef(err, "failed to start discovery responder")
+		}
+		activeInputsMu.Lock()
+		activeInputs = append(activeInputs, in)
+		activeInputsMu.Unlock()
+		inputs = append(inputs, in)
+	}
+	defer closeInputs()
+	reasm := NewReassembler(*flagFragMaxSize, *flagFragTimeout)
+	wp := NewWorkerPool(*flagWorkers, *flagQueueSize, func(p *packet) {
+		if p.li != nil {
+			li := newLineInfo(p.ts, p.src, p.li)
+			li.Listener = p.listener
+			handleLine(li)
+			return
+		}
+		authDevice, data, ok := unwrapPayload(p.src, p.data, p.datagram)
+		if !ok {
+			return
+		}
+		if !checkPayloadLen(p.src, data) {
+			return
+		}
+		p.data = data
+		if pp, ok := parserFor(p.src).(logline.PacketParser); ok {
+			processPacket(pp, p.ts, p.src, p.listener, authDevice, p.data)
+			return
+		}
+		lines := limitLines(p.src, reasm.Feed(p.ts, p.src, p.data))
+		if *flagJoinCont {
+			lj := &lineJoiner{listener: p.listener, authDevice: authDevice}
+			for _, line := range lines {
+				if err := lj.Add(p.ts, p.src, line); err != nil {
+					klog.Errorf("invalid log message %q: %v", string(line), err)
+				}
+			}
+			lj.Flush()
+			return
+		}
+		for _, line := range lines {
+			if err := processLine(p.ts, p.src, p.listener, authDevice, line); err != nil {
 				klog.Errorf("invalid log message %q: %v", string(line), err)
 			}
 		}
+	})
+	if *flagHTTPAddr != "" {
+		http.Handle("/ingest", &httpIngestHandler{wp: wp})
+		http.Handle("/ingest/ws", &wsIngestHandler{wp: wp})
+	}
+	errCh := make(chan error, len(inputs))
+	for _, in := range inputs {
+		go func(in inputSource) {
+			errCh <- in.Run(wp)
+		}(in)
+	}
+	return <-errCh
+}
+
+// listenMulticast opens a socket and joins the multicast group on the specified interface,
+// or the system default one if ifName is empty.
+func listenMulticast(network string, addr *net.UDPAddr, ifName string) (*net.UDPConn, error) {
+	var ifi *net.Interface
+	if ifName != "" {
+		var err error
+		if ifi, err = net.InterfaceByName(ifName); err != nil {
+			return nil, errors.Annotatef(err, "invalid --multicast-iface")
+		}
+	}
+	c, err := net.ListenMulticastUDP(network, ifi, addr)
+	if err != nil {
+		return nil, errors.Annotatef(err, "failed to join multicast group %s", addr.IP)
+	}
+	return c, nil
+}
+
+// listenUDP opens n sockets bound to the same address.
+// If there is more than one, SO_REUSEPORT is used to distribute packets between them.
+func listenUDP(network string, addr *net.UDPAddr, n int) ([]*net.UDPConn, error) {
+	if addr.IP.IsMulticast() {
+		// Every socket joined to the group gets a copy of each packet, so only one is used.
+		c, err := listenMulticast(network, addr, *flagMcastIface)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		return []*net.UDPConn{c}, nil
+	}
+	if n > 1 && !reusePortSupported {
+		klog.Warningf("SO_REUSEPORT is not supported on this platform, using one socket")
+		n = 1
+	}
+	if n <= 1 {
+		c, err := net.ListenUDP(network, addr)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		return []*net.UDPConn{c}, nil
+	}
+	lc := net.ListenConfig{Control: reusePortControl}
+	var res []*net.UDPConn
+	for i := 0; i < n; i++ {
+		c, err := lc.ListenPacket(context.Background(), network, addr.String())
+		if err != nil {
+			for _, c := range res {
+				c.Close()
+			}
+			return nil, errors.Trace(err)
+		}
+		res = append(res, c.(*net.UDPConn))
+	}
+	return res, nil
+}
+
+// receive reads packets from the socket and hands them over to the workers.
+func receive(c *net.UDPConn, listener string, wp *WorkerPool, dropAcct bool) error {
+	var oob []byte
+	if dropAcct {
+		oob = make([]byte, 64)
+	}
+	var lastKernelDrops uint32
+	for {
+		buf := pktBufPool.Get().(*[]byte)
+		n, oobn, flags, src, err := c.ReadMsgUDP(*buf, oob)
+		if err != nil {
+			pktBufPool.Put(buf)
+			return errors.Annotatef(err, "socket read error")
+		}
+		if oobn > 0 {
+			countKernelDrops(c, oob[:oobn], &lastKernelDrops)
+		}
+		if isTruncated(flags) {
+			countTruncated(src)
+		}
+		enqueueDatagram(buf, n, src, listener, wp)
+	}
+}
+
+func countTruncated(src *net.UDPAddr) {
+	truncatedPackets.Add(1)
+	klog.V(1).Infof("Packet from %s was truncated to %d bytes, consider increasing --max-packet-size", src, *flagMaxPktSize)
+}
+
+// countKernelDrops accounts for receive buffer overflows reported in the control messages.
+// The counter is cumulative and is only reported after drops occur.
+func countKernelDrops(c *net.UDPConn, oob []byte, lastKernelDrops *uint32) {
+	if drops, ok := parseRxqOvfl(oob); ok && drops != *lastKernelDrops {
+		kernelDroppedPackets.Add(int64(drops - *lastKernelDrops))
+		klog.V(1).Infof("Kernel dropped %d packets on %s", drops-*lastKernelDrops, c.LocalAddr())
+		*lastKernelDrops = drops
+	}
+}
+
+// unwrapPayload verifies, decrypts and decompresses the packet data as configured.
+// Returns the device that signed or encrypted the packet, if any, and the payload.
+func unwrapPayload(src *net.UDPAddr, data []byte, datagram bool) (string, []byte, bool) {
+	authDevice := ""
+	if hmacVerifier != nil {
+		var ok bool
+		if authDevice, data, ok = hmacVerifier.VerifyPacket(data); !ok {
+			badHMACPackets.Add(1)
+			klog.V(1).Infof("Dropped packet from %s: HMAC verification failed", src)
+			return "", nil, false
+		}
+	}
+	if decryptor != nil {
+		encDevice, plain, err := decryptor.Decrypt(data)
+		switch {
+		case err != nil:
+			rejectedPackets.Add("decrypt_error", 1)
+			klog.V(1).Infof("Dropped packet from %s: %v", src, err)
+			return "", nil, false
+		case encDevice == "" && decryptor.HasKey(authDevice):
+			rejectedPackets.Add("not_encrypted", 1)
+			return "", nil, false
+		case encDevice != "" && authDevice != "" && encDevice != authDevice:
+			rejectedPackets.Add("device_mismatch", 1)
+			return "", nil, false
+		case encDevice != "":
+			authDevice = encDevice
+		}
+		data = plain
+	}
+	if datagram && *flagPayloadComp != "none" {
+		var err error
+		if data, err = decompressPayload(*flagPayloadComp, data); err != nil {
+			decompressErrors.Add(1)
+			klog.V(1).Infof("Failed to decompress packet from %s: %v", src, err)
+			return "", nil, false
+		}
+	}
+	return authDevice, data, true
+}
+
+// enqueueDatagram passes a received datagram to the workers, taking ownership of the buffer.
+func enqueueDatagram(buf *[]byte, n int, src *net.UDPAddr, listener string, wp *WorkerPool) {
+	rxPackets.Add(1)
+	rxBytes.Add(int64(n))
+	if mirror != nil {
+		mirror.Send((*buf)[:n])
+	}
+	p := &packet{
+		ts:       time.Now(),
+		src:      src,
+		data:     (*buf)[:n],
+		buf:      buf,
+		listener: listener,
+		datagram: true,
+	}
+	if !wp.Enqueue(p) {
+		p.release()
+		droppedPackets.Add(1)
+		klog.V(1).Infof("Queue full, dropped packet from %s", src)
+	}
+}
+
+func fileManagerOptions() *FileManagerOptions {
+	return &FileManagerOptions{
+		RecordFormat:       *flagFileFormat,
+		Encoding:           *flagFileEncoding,
+		NameTemplate:       *flagFileNameTmpl,
+		LatestNameTemplate: *flagLatestTmpl,
+		CombinedFile:       *flagCombinedFile,
+		RecordSeparator:    recordSep,
+		MaxOpenFiles:       *flagMaxOpenFiles,
+		OfflineTimeout:     *flagOfflineTmout,
+		SplitByFD:          *flagSplitByFD,
+		IncludeSrc:         *flagNameIncSrc,
+		FlatLayout:         *flagFlatLayout,
+		Retention:          *flagRetention,
+		FlushInterval:      *flagFlushIntvl,
+		FlushOnError:       *flagFlushOnError,
+		SplitConflicting:   *flagSplitConfl,
+		Fsync:              *flagFsync,
 	}
-	return nil
+}
+
+// unescape interprets Go-style escape sequences, e.g. \n, \r, \t, \x00, and also \0 as NUL.
+func unescape(s string) (string, error) {
+	var sb strings.Builder
+	for len(s) > 0 {
+		if strings.HasPrefix(s, `\0`) && (len(s) == 2 || s[2] < '0' || s[2] > '7') {
+			sb.WriteByte(0)
+			s = s[2:]
+			continue
+		}
+		c, multibyte, tail, err := strconv.UnquoteChar(s, 0)
+		if err != nil {
+			return "", errors.Errorf("invalid escape sequence in %q", s)
+		}
+		if multibyte {
+			sb.WriteRune(c)
+		} else {
+			sb.WriteByte(byte(c))
+		}
+		s = tail
+	}
+	return sb.String(), nil
+}
+
+func parseFileMode(s string) (os.FileMode, error) {
+	v, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || v > 0o777 {
+		return 0, errors.Errorf("invalid mode %q", s)
+	}
+	return os.FileMode(v), nil
+}
+
+// parseListenURL parses scheme://addr style address, UDP is assumed if there is no scheme.
+func parseListenURL(spec string) (*url.URL, error) {
+	if !strings.Contains(spec, "://") {
+		spec = "udp://" + spec
+	}
+	purl, err := url.Parse(spec)
+	return purl, errors.Trace(err)
+}
+
+// parseListenAddr parses udp://addr:port/ style address.
+// udp4:// and udp6:// can be used to restrict address family, IPv6 addresses must be bracketed.
+// Without a scheme, addr:port and :port are accepted as UDP.
+func parseListenAddr(spec string) (string, *net.UDPAddr, error) {
+	purl, err := parseListenURL(spec)
+	if err != nil {
+		return "", nil, errors.Trace(err)
+	}
+	switch purl.Scheme {
+	case "udp", "udp4", "udp6":
+	default:
+		return "", nil, errors.Errorf("scheme must be udp://, udp4:// or udp6://")
+	}
+	if _, err := strconv.Atoi(purl.Port()); err != nil {
+		return "", nil, errors.Errorf("invalid UDP port format, must be udp://:port/, udp://ip:port/, ip:port or :port")
+	}
+	addr, err := net.ResolveUDPAddr(purl.Scheme, purl.Host)
+	if err != nil {
+		return "", nil, errors.Trace(err)
+	}
+	return purl.Scheme, addr, nil
 }
 
 type LineInfo struct {
+	logline.LineInfo
 	Src       *net.UDPAddr
 	Timestamp time.Time
-	DeviceID  string
-	SeqNum    uint64
-	UptimeMs  uint64
-	FD        uint
-	Level     uint
-	Msg       string
 	// These are derived.
+	Uptime       string // Formatted as 1h02m03.456s
 	TimestampStr string // Formatted acoording to --timestamp format
+	UnixMillis   int64  // Timestamp as milliseconds since epoch.
+	UnixNanos    int64  // Timestamp as nanoseconds since epoch.
 	DeviceIDSafe string // Sanitized, suitable for use in filenames.
 	Year         string // YYYY
 	Month        string // mm
 	Day          string // dd
-	LevelChar    string // E, W, I, D, V
+	Hour         string // HH
+	LevelChar    string // E, W, I, D, V or as specified by --level-map.
+	LevelName    string // error, warning, info, debug, verbose or as specified by --level-map.
+	FDName       string // Name of the stream as specified by --fd-names, or the number.
+	SrcHost      string // Host name of the source with --resolve-src, IP address otherwise.
+	SrcSafe      string // Source IP address, sanitized.
+	Listener     string // Tag of the listener the line was received on.
+	// Time according to the device: reported by the sender (e.g. syslog timestamp)
+	// or derived from uptime with --use-uptime-delta.
+	DeviceTime    time.Time
+	DeviceTimeStr string
 }
 
 func parseLine(ts time.Time, src *net.UDPAddr, line []byte) (*LineInfo, error) {
-	infoStr, msg, found := bytes.Cut(line, []byte("|"))
-	if !found {
-		return nil, fmt.Errorf("missing msg delimiter")
+	if err := checkNUL(line); err != nil {
+		return nil, err
 	}
-	parts := bytes.Split(infoStr, []byte(" "))
-	if len(parts) != 5 {
-		return nil, fmt.Errorf("invalid number of parts")
+	pli, err := parseWithRules(src, line)
+	if err != nil {
+		return nil, err
 	}
-	var li LineInfo
-	if len(parts[0]) > 0 && len(parts[0]) <= 50 {
-		li.DeviceID = string(parts[0])
-	} else {
-		return nil, fmt.Errorf("invalid device id")
+	return newLineInfo(ts, src, pli), nil
+}
+
+// newLineInfo fills in the derived fields of a parsed line.
+func newLineInfo(ts time.Time, src *net.UDPAddr, pli *logline.LineInfo) *LineInfo {
+	li := LineInfo{LineInfo: *pli}
+	// Some formats do not have device ID, the source address is used instead.
+	if li.DeviceID == "" {
+		li.DeviceID = src.IP.String()
 	}
-	if v, err := strconv.ParseUint(string(parts[1]), 10, 64); err == nil {
-		li.SeqNum = v
-	} else {
-		return nil, fmt.Errorf("invalid seqnum")
+	if *flagLogfmt {
+		if kv := logline.ParseLogfmt(li.Msg); kv != nil {
+			// Fields set by the input format take precedence.
+			for k, v := range li.Fields {
+				kv[k] = v
+			}
+			li.Fields = kv
+		}
 	}
-	if v, err := strconv.ParseFloat(string(parts[2]), 64); err == nil {
-		li.UptimeMs = uint64(v * 1000)
-	} else {
-		return nil, fmt.Errorf("invalid uptime")
+	if msgTimeFormat != "" && li.Time.IsZero() {
+		if t, msg, ok := extractMsgTime(li.Msg, msgTimeFormat, ts); ok {
+			li.Time = t
+			if !*flagKeepMsgTime {
+				li.Msg = msg
+			}
+		}
 	}
-	if v, err := strconv.ParseUint(string(parts[3]), 10, 32); err == nil {
-		li.FD = uint(v)
-	} else {
-		return nil, fmt.Errorf("invalid fd")
+	if !li.Time.IsZero() {
+		li.DeviceTime = li.Time
+		li.DeviceTimeStr = FormatTimestamp(li.Time)
 	}
-	if v, err := strconv.ParseUint(string(parts[4]), 10, 32); err == nil {
-		li.Level = uint(v)
+	li.Src = src
+	if resolver != nil {
+		li.SrcHost = resolver.Lookup(src.IP)
 	} else {
-		return nil, fmt.Errorf("invalid level")
+		li.SrcHost = src.IP.String()
 	}
-	for i, c := range parts[0] {
-		if !safeChars[c] {
-			parts[0][i] = '_'
-		}
-	}
-	li.Src = src
-	li.DeviceIDSafe = string(parts[0])
+	li.DeviceIDSafe = sanitize(li.DeviceID)
+	li.SrcSafe = sanitize(src.IP.String())
 	li.Timestamp = ts
-	li.Msg = string(msg)
-	ds := ts.Format("20060102")
+	li.UnixMillis = ts.UnixMilli()
+	li.UnixNanos = ts.UnixNano()
+	ds := ts.Format("2006010215")
 	li.Year = ds[:4]
 	li.Month = ds[4:6]
 	li.Day = ds[6:8]
-	switch li.Level {
-	case 0:
-		li.LevelChar = "E"
-	case 1:
-		li.LevelChar = "W"
-	case 2:
-		li.LevelChar = "I"
-	case 3:
-		li.LevelChar = "D"
-	case 4:
-		li.LevelChar = "V"
-	default:
-		li.LevelChar = fmt.Sprintf("%d", li.Level%10)
+	li.Hour = ds[8:10]
+	if ln, ok := levelNames[li.Level]; ok {
+		li.LevelChar, li.LevelName = ln.char, ln.name
+	} else {
+		li.LevelChar, li.LevelName = logline.LevelChar(li.Level), logline.LevelName(li.Level)
 	}
 	li.TimestampStr = FormatTimestamp(ts)
-	return &li, nil
+	li.Uptime = FormatUptime(li.UptimeMs)
+	if name, ok := fdNames[li.FD]; ok {
+		li.FDName = name
+	} else {
+		li.FDName = strconv.Itoa(int(li.FD))
+	}
+	return &li
+}
+
+type levelName struct {
+	char string
+	name string
+}
+
+// parseLevelMap parses --level-map entries, level=C:name.
+func parseLevelMap(spec map[string]string) (map[uint]levelName, error) {
+	res := make(map[uint]levelName)
+	for k, v := range spec {
+		level, err := strconv.ParseUint(k, 10, 32)
+		if err != nil {
+			return nil, errors.Errorf("invalid level %q", k)
+		}
+		c, name, _ := strings.Cut(v, ":")
+		if utf8.RuneCountInString(c) != 1 || name == "" {
+			return nil, errors.Errorf("invalid name for level %d: %q, expected C:name", level, v)
+		}
+		res[uint(level)] = levelName{char: c, name: name}
+	}
+	return res, nil
+}
+
+// parseFDNames parses fd:name or fd=name pairs.
+// Names end up in file names, so they must consist of safe characters.
+func parseFDNames(spec []string) (map[uint]string, error) {
+	res := make(map[uint]string)
+	for _, e := range spec {
+		k, v, ok := strings.Cut(e, ":")
+		if !ok {
+			k, v, ok = strings.Cut(e, "=")
+		}
+		if !ok {
+			return nil, errors.Errorf("%q is not fd:name", e)
+		}
+		fd, err := strconv.ParseUint(k, 10, 32)
+		if err != nil {
+			return nil, errors.Errorf("invalid fd number %q", k)
+		}
+		if v == "" {
+			return nil, errors.Errorf("empty name for fd %d", fd)
+		}
+		if v == "." || v == ".." || sanitize(v) != v {
+			return nil, errors.Errorf("name %q for fd %d is not safe for use in file names", v, fd)
+		}
+		res[uint(fd)] = v
+	}
+	return res, nil
+}
+
+// initSafeChars builds the table of characters allowed in file names:
+// letters, digits, "-_., " and any extra ones.
+func initSafeChars(extra, repl string) error {
+	for i := 0; i < 256; i++ {
+		c := byte(i)
+		safeChars[i] = ((c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') ||
+			(c >= '0' && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == ',' || c == ' ')
+	}
+	for _, c := range []byte(extra) {
+		if c == '/' || c == 0 || c >= 0x80 {
+			return errors.Errorf("%q is not allowed in file names", c)
+		}
+		safeChars[c] = true
+	}
+	if len(repl) != 1 || !safeChars[repl[0]] {
+		return errors.Errorf("replacement must be a single safe character, got %q", repl)
+	}
+	replacementChar = repl[0]
+	return nil
+}
+
+// sanitize replaces characters that are not safe for use in file names.
+func sanitize(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		if !safeChars[c] {
+			b[i] = replacementChar
+		}
+	}
+	return string(b)
 }
 
-func processLine(ts time.Time, src *net.UDPAddr, line []byte, fm *FileManager) error {
+// processLine parses and handles a line. authDevice is the device that signed or encrypted the packet, if any.
+func processLine(ts time.Time, src *net.UDPAddr, listener, authDevice string, line []byte) error {
 	li, err := parseLine(ts, src, line)
 	if err != nil {
-		return errors.Trace(err)
-	}
-	if stdoutTmpl != nil {
-		stdoutTmpl.Execute(os.Stdout, li)
-		os.Stdout.Write([]byte{'\n'})
+		countParseError(ts, src, line, err)
+		if !*flagLenient {
+			return errors.Trace(err)
+		}
+		li = rawLineInfo(ts, src, line, err)
 	}
-	if fm != nil {
-		fm.WriteLine(li)
+	li.Listener = listener
+	if reason := checkAuth(li, line, authDevice); reason != "" {
+		countDrop(li, reason)
+		return nil
 	}
+	handleLine(li)
 	return nil
 }
 
+// processPacket handles a packet in a binary format that is parsed as a whole.
+func processPacket(pp logline.PacketParser, ts time.Time, src *net.UDPAddr, listener, authDevice string, data []byte) {
+	plis, err := pp.ParsePacket(data)
+	if n := *flagMaxPktLines; n > 0 && len(plis) > n {
+		limitExceeded.Add("packet_lines", int64(len(plis)-n))
+		plis = plis[:n]
+	}
+	for _, pli := range plis {
+		li := newLineInfo(ts, src, pli)
+		li.Listener = listener
+		if reason := checkAuth(li, nil, authDevice); reason != "" {
+			countDrop(li, reason)
+			continue
+		}
+		handleLine(li)
+	}
+	if err != nil {
+		countParseError(ts, src, data, err)
+		klog.Errorf("invalid packet from %s: %v", src, err)
+	}
+}
+
+// rawLineInfo returns a line that could not be parsed as an info message from the source address.
+// The reason is stored in Fields as "parse_error".
+func rawLineInfo(ts time.Time, src *net.UDPAddr, line []byte, err error) *LineInfo {
+	return newLineInfo(ts, src, &logline.LineInfo{
+		Level:  2,
+		Msg:    string(line),
+		Fields: map[string]string{"parse_error": parseErrorReason(err)},
+	})
+}
+
+// checkAuth verifies the line's signature or the packet it came in, returns the drop reason if verification failed.
+// authDevice is the device that signed or encrypted the packet, if any.
+func checkAuth(li *LineInfo, line []byte, authDevice string) string {
+	switch {
+	case authDevice != "" && li.DeviceID != authDevice:
+		return "device_mismatch"
+	case hmacVerifier != nil && !hmacVerifier.Verify(li, line, authDevice):
+		return "bad_hmac"
+	case decryptor != nil && authDevice == "" && decryptor.HasKey(li.DeviceID):
+		return "not_encrypted"
+	}
+	return ""
+}
+
+// handleLine filters a parsed line and passes it on for writing.
+func handleLine(li *LineInfo) {
+	parsedLines.Add(1)
+	countActiveDevice(li)
+	cfg := getDynConfig()
+	if cfg.devFilter != nil {
+		if reason := cfg.devFilter.Check(li.DeviceID); reason != "" {
+			countDrop(li, reason)
+			return
+		}
+	}
+	if cfg.fdFilter != nil {
+		if reason := cfg.fdFilter.Check(li.FDName); reason != "" {
+			countDrop(li, "stream_"+reason)
+			return
+		}
+	}
+	if cfg.minLevel >= 0 && li.Level > uint(cfg.minLevel) {
+		countDrop(li, "level")
+		return
+	}
+	if li.UptimeMs < uint64(flagMinUptime.Milliseconds()) {
+		countDrop(li, "early_boot")
+		return
+	}
+	if dedup != nil && dedup.IsDuplicate(li) {
+		countDrop(li, "duplicate")
+		return
+	}
+	if rateLimit != nil && !rateLimit.Allow(li) {
+		countDrop(li, "rate_limit")
+		return
+	}
+	if devClock != nil {
+		devClock.Update(li)
+	}
+	if reorderer != nil {
+		for _, rli := range reorderer.Add(li) {
+			emitLine(rli)
+		}
+		return
+	}
+	emitLine(li)
+}
+
+// emitLine passes the line through continuation grouping and record assembly and writes it out.
+func emitLine(li *LineInfo) {
+	if grouper != nil {
+		for _, gli := range grouper.Add(li) {
+			assembleLine(gli)
+		}
+		return
+	}
+	assembleLine(li)
+}
+
+func assembleLine(li *LineInfo) {
+	if recAsm != nil {
+		for _, rli := range recAsm.Add(li) {
+			writeLine(rli)
+		}
+		return
+	}
+	writeLine(li)
+}
+
+// flushPending writes out all the lines held for reordering, grouping and record assembly.
+func flushPending() {
+	if reorderer != nil {
+		for _, li := range reorderer.Flush() {
+			emitLine(li)
+		}
+	}
+	if grouper != nil {
+		for _, li := range grouper.Flush() {
+			assembleLine(li)
+		}
+	}
+	if recAsm != nil {
+		for _, li := range recAsm.Flush() {
+			writeLine(li)
+		}
+	}
+}
+
+// expireGroups periodically writes out grouped lines that are not getting any more continuations.
+func expireGroups() {
+	for now := range time.Tick(*flagContTimeout / 4) {
+		for _, li := range grouper.Expire(now) {
+			assembleLine(li)
+		}
+	}
+}
+
+// expireRecords periodically writes out records that have not been terminated within --record-timeout.
+func expireRecords() {
+	for now := range time.Tick(*flagRecordTO / 4) {
+		for _, li := range recAsm.Expired(now) {
+			writeLine(li)
+		}
+	}
+}
+
+// writeLine prepares the message for output and passes the line to all the sinks.
+func writeLine(li *LineInfo) {
+	if msg := fixUTF8(li.Msg, *flagInvalidUTF8); msg != li.Msg {
+		fli := *li
+		fli.Msg = msg
+		li = &fli
+	}
+	if msg, ok := truncateMsg(li.Msg, *flagMaxMsgLen); ok {
+		tli := *li
+		tli.Msg = msg
+		li = &tli
+		truncatedLines.Add(1)
+	}
+	stripped := li
+	if *flagStripANSI {
+		if msg := stripANSI(li.Msg); msg != li.Msg {
+			sli := *li
+			sli.Msg = msg
+			stripped = &sli
+		}
+	}
+	for _, s := range sinks {
+		if s.keepANSI {
+			s.Write(li)
+		} else {
+			s.Write(stripped)
+		}
+	}
+}
+
+// Alternative names accepted for some of the flags.
+var flagAliases = map[string]string{
+	"listeners":         "receivers",
+	"recv-buffer-bytes": "rcvbuf",
+	"parser":            "input-format",
+	"field-delim":       "field-delimiter",
+	"msg-delim":         "msg-delimiter",
+}
+
 func main() {
+	flag.CommandLine.SetNormalizeFunc(func(f *flag.FlagSet, name string) flag.NormalizedName {
+		if n, ok := flagAliases[name]; ok {
+			name = n
+		}
+		return flag.NormalizedName(name)
+	})
 	klog.InitFlags(nil)
 	flag.CommandLine.AddGoFlag(stdFlag.CommandLine.Lookup("v"))
 	flag.CommandLine.AddGoFlag(stdFlag.CommandLine.Lookup("logtostderr"))
@@ -221,11 +1136,16 @@ func main() {
 	flag.Parse()
 	defer klog.Flush()
 
-	for i := 0; i < 256; i++ {
-		c := byte(i)
-		safeChars[i] = ((c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') ||
-			(c >= '0' && c <= '9') ||
-			c == '-' || c == '_' || c == '.' || c == ',' || c == ' ')
+	flag.Visit(func(f *flag.Flag) { cliFlags[f.Name] = true })
+	if *flagConfig != "" {
+		cfg, err := readConfigFile(*flagConfig)
+		if err == nil {
+			err = applyConfig(flag.CommandLine, cfg, nil)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: invalid config: %s\n", err)
+			os.Exit(1)
+		}
 	}
 
 	if err := UDPLog(); err != nil {
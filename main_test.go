@@ -0,0 +1,112 @@
+/*
+ * Copyright (c) 2022 Deomid "rojer" Ryabkov
+ * All rights reserved
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"net"
+	"sync"
+	"testing"
+)
+
+func TestParseListenAddr(t *testing.T) {
+	for _, tc := range []struct {
+		spec    string
+		network string
+		addr    string
+	}{
+		{":1514", "udp", ":1514"},
+		{"0.0.0.0:1514", "udp", "0.0.0.0:1514"},
+		{"udp://:1514/", "udp", ":1514"},
+		{"udp://1.2.3.4:1514/", "udp", "1.2.3.4:1514"},
+		{"udp://[::1]:1234/", "udp", "[::1]:1234"},
+		{"udp6://[::]:1234/", "udp6", "[::]:1234"},
+		{"udp6://[fe80::1%25lo]:1234/", "udp6", "[fe80::1%lo]:1234"},
+		{"udp4://:1234/", "udp4", ":1234"},
+		{"udp4://127.0.0.1:1234/", "udp4", "127.0.0.1:1234"},
+		{"[::1]:1234", "udp", "[::1]:1234"},
+	} {
+		network, addr, err := parseListenAddr(tc.spec)
+		if err != nil {
+			t.Errorf("parseListenAddr(%q): unexpected error: %v", tc.spec, err)
+			continue
+		}
+		if network != tc.network || addr.String() != tc.addr {
+			t.Errorf("parseListenAddr(%q): got %s %s, want %s %s", tc.spec, network, addr, tc.network, tc.addr)
+		}
+	}
+	for _, spec := range []string{"tcp://:1514/", "udp://:port/", "udp://1.2.3.4/", "1514", "udp://::1:1234/"} {
+		if _, _, err := parseListenAddr(spec); err == nil {
+			t.Errorf("parseListenAddr(%q): expected an error", spec)
+		}
+	}
+}
+
+func TestParseFDNames(t *testing.T) {
+	if err := initSafeChars("", "_"); err != nil {
+		t.Fatal(err)
+	}
+	names, err := parseFDNames([]string{"1:stdout", "2=stderr", "3:net.bridge"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(names) != 3 || names[1] != "stdout" || names[2] != "stderr" || names[3] != "net.bridge" {
+		t.Errorf("unexpected result: %v", names)
+	}
+	for _, spec := range []string{"1", "x:stdout", "1:", "1:..", "1:a/b", "1:../x"} {
+		if _, err := parseFDNames([]string{spec}); err == nil {
+			t.Errorf("parseFDNames(%q): expected an error", spec)
+		}
+	}
+}
+
+// benchmarkWorkerPool pushes packets through the worker pool the way the UDP receive loop does,
+// with buffers taken from pktBufPool or allocated for every packet.
+func benchmarkWorkerPool(b *testing.B, usePool bool) {
+	var wg sync.WaitGroup
+	wp := NewWorkerPool(4, 100, func(p *packet) { wg.Done() })
+	src := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}
+	line := []byte("esp32_123456 7 12.345 1 2|hello world\n")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		p := &packet{src: src}
+		if usePool {
+			p.buf = pktBufPool.Get().(*[]byte)
+		} else {
+			buf := make([]byte, *flagMaxPktSize)
+			p.buf = &buf
+		}
+		n := copy(*p.buf, line)
+		p.data = (*p.buf)[:n]
+		if !usePool {
+			// Not returned to the pool.
+			p.buf = nil
+		}
+		wg.Add(1)
+		wp.EnqueueWait(p)
+	}
+	wg.Wait()
+}
+
+func BenchmarkWorkerPoolBufPool(b *testing.B) {
+	benchmarkWorkerPool(b, true)
+}
+
+func BenchmarkWorkerPoolNoBufPool(b *testing.B) {
+	benchmarkWorkerPool(b, false)
+}
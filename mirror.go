@@ -0,0 +1,77 @@
+/*
+ * Copyright (c) 2022 Deomid "rojer" Ryabkov
+ * All rights reserved
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	klog "k8s.io/klog/v2"
+)
+
+const mirrorReportInterval = 10 * time.Second
+
+// Mirror re-sends received datagrams verbatim to other collectors.
+type Mirror struct {
+	targets    []*net.UDPConn
+	mu         sync.Mutex
+	failed     uint64
+	lastErr    error
+	lastReport time.Time
+}
+
+func NewMirror(specs []string) (*Mirror, error) {
+	m := &Mirror{}
+	for _, spec := range specs {
+		network, addr, err := parseListenAddr(spec)
+		if err != nil {
+			return nil, errors.Annotatef(err, "invalid mirror address %q", spec)
+		}
+		c, err := net.DialUDP(network, nil, addr)
+		if err != nil {
+			return nil, errors.Annotatef(err, "failed to open mirror socket for %s", spec)
+		}
+		klog.Infof("Mirroring packets to %s", addr)
+		m.targets = append(m.targets, c)
+	}
+	return m, nil
+}
+
+// Send forwards the packet to all the targets. Failures are counted and reported periodically.
+func (m *Mirror) Send(data []byte) {
+	for _, c := range m.targets {
+		if _, err := c.Write(data); err != nil {
+			mirrorErrors.Add(1)
+			m.reportError(err)
+		}
+	}
+}
+
+func (m *Mirror) reportError(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.failed++
+	m.lastErr = err
+	if now := time.Now(); now.Sub(m.lastReport) >= mirrorReportInterval {
+		klog.Warningf("Failed to mirror %d packets, last error: %v", m.failed, m.lastErr)
+		m.failed = 0
+		m.lastReport = now
+	}
+}
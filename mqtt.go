@@ -0,0 +1,301 @@
+/*
+ * Copyright (c) 2022 Deomid "rojer" Ryabkov
+ * All rights reserved
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	klog "k8s.io/klog/v2"
+)
+
+const (
+	mqttKeepAlive      = 60 * time.Second
+	mqttReconnectDelay = 5 * time.Second
+)
+
+// MQTT control packet types.
+const (
+	mqttConnect   = 1
+	mqttConnAck   = 2
+	mqttPublish   = 3
+	mqttSubscribe = 8
+	mqttSubAck    = 9
+	mqttPingReq   = 12
+	mqttPingResp  = 13
+)
+
+// mqttInput subscribes to a topic on an MQTT broker and processes messages as log lines.
+// This is a minimal MQTT 3.1.1 client: QoS 0 only, reconnects on errors.
+type mqttInput struct {
+	u        *url.URL
+	topic    string
+	clientID string
+	mu       sync.Mutex
+	c        net.Conn
+	done     bool
+}
+
+// newMQTTInput validates the broker address: tcp://host:port or ssl://host:port,
+// user name and password can be specified as user:pass@.
+// If clientID is empty, a unique one is generated.
+func newMQTTInput(broker, topic, clientID string) (*mqttInput, error) {
+	u, err := url.Parse(broker)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	switch u.Scheme {
+	case "tcp", "mqtt":
+		if u.Port() == "" {
+			u.Host += ":1883"
+		}
+	case "ssl", "tls", "mqtts":
+		if u.Port() == "" {
+			u.Host += ":8883"
+		}
+	default:
+		return nil, errors.Errorf("scheme must be tcp:// or ssl://")
+	}
+	if topic == "" {
+		return nil, errors.Errorf("topic is required")
+	}
+	if clientID == "" {
+		// Must be unique across all the catchers subscribed to the broker.
+		host, _ := os.Hostname()
+		rb := make([]byte, 4)
+		if _, err := rand.Read(rb); err != nil {
+			return nil, errors.Trace(err)
+		}
+		clientID = fmt.Sprintf("mos_udp_log_catcher-%s-%s", host, hex.EncodeToString(rb))
+	}
+	return &mqttInput{u: u, topic: topic, clientID: clientID}, nil
+}
+
+func (in *mqttInput) Run(wp *WorkerPool) error {
+	for {
+		err := in.session(wp)
+		in.mu.Lock()
+		done := in.done
+		in.mu.Unlock()
+		if done {
+			return errors.Annotatef(err, "MQTT input closed")
+		}
+		klog.Errorf("MQTT %s: %v, reconnecting in %s", in.u.Host, err, mqttReconnectDelay)
+		time.Sleep(mqttReconnectDelay)
+	}
+}
+
+func (in *mqttInput) Close() error {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.done = true
+	if in.c != nil {
+		return in.c.Close()
+	}
+	return nil
+}
+
+// session connects, subscribes and processes messages until an error occurs.
+func (in *mqttInput) session(wp *WorkerPool) error {
+	var c net.Conn
+	var err error
+	if in.u.Scheme == "tcp" || in.u.Scheme == "mqtt" {
+		c, err = net.DialTimeout("tcp", in.u.Host, 30*time.Second)
+	} else {
+		c, err = tls.DialWithDialer(&net.Dialer{Timeout: 30 * time.Second}, "tcp", in.u.Host, &tls.Config{ServerName: in.u.Hostname()})
+	}
+	if err != nil {
+		return errors.Trace(err)
+	}
+	in.mu.Lock()
+	if in.done {
+		// Closed while connecting.
+		in.mu.Unlock()
+		c.Close()
+		return errors.Errorf("closed")
+	}
+	in.c = c
+	in.mu.Unlock()
+	defer c.Close()
+	r := bufio.NewReader(c)
+	if err := in.connect(c, r); err != nil {
+		return errors.Trace(err)
+	}
+	klog.Infof("MQTT: connected to %s, subscribed to %s", in.u.Host, in.topic)
+	// Keep-alive pings, the broker disconnects us if they stop.
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		t := time.NewTicker(mqttKeepAlive / 2)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				c.Write([]byte{mqttPingReq << 4, 0})
+			case <-stop:
+				return
+			}
+		}
+	}()
+	src := streamSrc(c.RemoteAddr())
+	for {
+		c.SetReadDeadline(time.Now().Add(mqttKeepAlive * 3 / 2))
+		ptype, flags, body, err := mqttReadPacket(r)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		switch ptype {
+		case mqttPublish:
+			if len(body) < 2 {
+				return errors.Errorf("invalid PUBLISH packet")
+			}
+			tlen := int(binary.BigEndian.Uint16(body))
+			payload := body[2:]
+			if len(payload) < tlen {
+				return errors.Errorf("invalid PUBLISH packet")
+			}
+			payload = payload[tlen:]
+			if qos := (flags >> 1) & 3; qos > 0 && len(payload) >= 2 {
+				// We subscribe with QoS 0 so this should not happen, but skip the packet id just in case.
+				payload = payload[2:]
+			}
+			if len(payload) == 0 {
+				continue
+			}
+			if payload[len(payload)-1] != '\n' {
+				payload = append(payload, '\n')
+			}
+			rxPackets.Add(1)
+			rxBytes.Add(int64(len(payload)))
+			wp.EnqueueWait(&packet{ts: time.Now(), src: src, data: payload, listener: "mqtt"})
+		case mqttPingResp:
+		default:
+			klog.V(1).Infof("MQTT: ignoring packet type %d", ptype)
+		}
+	}
+}
+
+func (in *mqttInput) connect(w io.Writer, r *bufio.Reader) error {
+	var vh []byte
+	vh = mqttAppendString(vh, "MQTT")
+	flags := byte(0x02) // Clean session.
+	if in.u.User != nil {
+		flags |= 0x80
+		if _, ok := in.u.User.Password(); ok {
+			flags |= 0x40
+		}
+	}
+	vh = append(vh, 4, flags, byte(mqttKeepAlive/time.Second>>8), byte(mqttKeepAlive/time.Second))
+	vh = mqttAppendString(vh, in.clientID)
+	if in.u.User != nil {
+		vh = mqttAppendString(vh, in.u.User.Username())
+		if pass, ok := in.u.User.Password(); ok {
+			vh = mqttAppendString(vh, pass)
+		}
+	}
+	if _, err := w.Write(mqttPacket(mqttConnect<<4, vh)); err != nil {
+		return errors.Trace(err)
+	}
+	ptype, _, body, err := mqttReadPacket(r)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if ptype != mqttConnAck || len(body) < 2 {
+		return errors.Errorf("unexpected response to CONNECT: %d", ptype)
+	}
+	if body[1] != 0 {
+		return errors.Errorf("connection refused, code %d", body[1])
+	}
+	sub := []byte{0, 1} // Packet id.
+	sub = mqttAppendString(sub, in.topic)
+	sub = append(sub, 0) // QoS 0.
+	if _, err := w.Write(mqttPacket(mqttSubscribe<<4|2, sub)); err != nil {
+		return errors.Trace(err)
+	}
+	ptype, _, body, err = mqttReadPacket(r)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if ptype != mqttSubAck || len(body) < 3 || body[2] == 0x80 {
+		return errors.Errorf("subscription to %s failed", in.topic)
+	}
+	return nil
+}
+
+func mqttAppendString(b []byte, s string) []byte {
+	b = append(b, byte(len(s)>>8), byte(len(s)))
+	return append(b, s...)
+}
+
+func mqttPacket(hdr byte, body []byte) []byte {
+	res := []byte{hdr}
+	n := len(body)
+	for {
+		b := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			b |= 0x80
+		}
+		res = append(res, b)
+		if n == 0 {
+			break
+		}
+	}
+	return append(res, body...)
+}
+
+func mqttReadPacket(r *bufio.Reader) (byte, byte, []byte, error) {
+	hdr, err := r.ReadByte()
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	n, mult := 0, 1
+	for i := 0; ; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		n += int(b&0x7f) * mult
+		if b&0x80 == 0 {
+			break
+		}
+		if i == 3 {
+			return 0, 0, nil, errors.Errorf("invalid packet length")
+		}
+		mult *= 128
+	}
+	if n > maxStreamLineLen {
+		return 0, 0, nil, errors.Errorf("packet is too big (%d)", n)
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, 0, nil, err
+	}
+	return hdr >> 4, hdr & 0xf, body, nil
+}
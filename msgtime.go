@@ -0,0 +1,48 @@
+/*
+ * Copyright (c) 2022 Deomid "rojer" Ryabkov
+ * All rights reserved
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+var msgTimeFormat string // Set by --msg-time-format.
+
+// extractMsgTime parses a timestamp at the start of the message according to layout.
+// The timestamp must be followed by a space or the end of the message.
+// Returns the time and the rest of the message.
+// Timestamps without zone are in UTC, those without year are in the current year.
+func extractMsgTime(msg, layout string, now time.Time) (time.Time, string, bool) {
+	// Values can be somewhat longer than the layout, e.g. zone names or unpadded numbers.
+	maxLen := len(layout) + 16
+	for i := 1; i <= len(msg) && i <= maxLen; i++ {
+		if i < len(msg) && msg[i] != ' ' {
+			continue
+		}
+		t, err := time.Parse(layout, msg[:i])
+		if err != nil {
+			continue
+		}
+		if t.Year() == 0 {
+			t = t.AddDate(now.Year(), 0, 0)
+		}
+		return t, strings.TrimLeft(msg[i:], " "), true
+	}
+	return time.Time{}, msg, false
+}
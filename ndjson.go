@@ -0,0 +1,90 @@
+/*
+ * Copyright (c) 2022 Deomid "rojer" Ryabkov
+ * All rights reserved
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// jsonLine is the representation of a line in JSON output.
+type jsonLine struct {
+	Timestamp  time.Time         `json:"ts"`
+	UnixMillis int64             `json:"unix_ms"`
+	UnixNanos  int64             `json:"unix_ns"`
+	DeviceID   string            `json:"device_id"`
+	Src        string            `json:"src"`
+	SrcHost    string            `json:"src_host,omitempty"`
+	Listener   string            `json:"listener,omitempty"`
+	SeqNum     uint64            `json:"seq"`
+	UptimeMs   uint64            `json:"uptime_ms"`
+	FD         uint              `json:"fd"`
+	FDName     string            `json:"fd_name"`
+	Level      uint              `json:"level"`
+	LevelChar  string            `json:"level_char"`
+	LevelName  string            `json:"level_name"`
+	DeviceTime *time.Time        `json:"device_time,omitempty"`
+	Msg        string            `json:"msg"`
+	Fields     map[string]string `json:"fields,omitempty"`
+}
+
+// jsonFormat encodes lines as JSON objects, used for --stdout-format=json and --file-format=json.
+type jsonFormat struct{}
+
+func (jsonFormat) Format(li *LineInfo) (string, error) {
+	b, err := json.Marshal(newJSONLine(li))
+	return string(b), err
+}
+
+func newJSONLine(li *LineInfo) *jsonLine {
+	jl := &jsonLine{
+		Timestamp:  li.Timestamp,
+		UnixMillis: li.UnixMillis,
+		UnixNanos:  li.UnixNanos,
+		DeviceID:   li.DeviceID,
+		Listener:   li.Listener,
+		SeqNum:     li.SeqNum,
+		UptimeMs:   li.UptimeMs,
+		FD:         li.FD,
+		FDName:     li.FDName,
+		Level:      li.Level,
+		LevelChar:  li.LevelChar,
+		LevelName:  li.LevelName,
+		Msg:        li.Msg,
+		Fields:     li.Fields,
+	}
+	if li.Src != nil {
+		jl.Src = li.Src.String()
+		if li.SrcHost != li.Src.IP.String() {
+			jl.SrcHost = li.SrcHost
+		}
+	}
+	if !li.DeviceTime.IsZero() {
+		jl.DeviceTime = &li.DeviceTime
+	}
+	return jl
+}
+
+// tmplJSON returns the value as JSON, lines are converted to jsonLine.
+func tmplJSON(v interface{}) (string, error) {
+	if li, ok := v.(*LineInfo); ok {
+		v = newJSONLine(li)
+	}
+	b, err := json.Marshal(v)
+	return string(b), err
+}
@@ -0,0 +1,198 @@
+/*
+ * Copyright (c) 2022 Deomid "rojer" Ryabkov
+ * All rights reserved
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/rojer/mos_udp_log_catcher/logline"
+	klog "k8s.io/klog/v2"
+)
+
+// pcap link types.
+const (
+	linkTypeNull     = 0
+	linkTypeEthernet = 1
+	linkTypeRaw      = 101
+	linkTypeLinuxSLL = 113
+	linkTypeIPv4     = 228
+	linkTypeIPv6     = 229
+)
+
+// replayPcap processes UDP payloads from a pcap capture file as if they were just received,
+// using capture timestamps. If port is not 0, only packets sent to this port are used.
+// IP fragments are not reassembled and are skipped.
+func replayPcap(fname string, port int) error {
+	f, err := os.Open(fname)
+	if err != nil {
+		return errors.Annotatef(err, "failed to open pcap file")
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	var hdr [24]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return errors.Annotatef(err, "failed to read pcap header")
+	}
+	var bo binary.ByteOrder
+	nanos := false
+	switch magic := binary.LittleEndian.Uint32(hdr[:4]); magic {
+	case 0xa1b2c3d4:
+		bo = binary.LittleEndian
+	case 0xd4c3b2a1:
+		bo = binary.BigEndian
+	case 0xa1b23c4d:
+		bo, nanos = binary.LittleEndian, true
+	case 0x4d3cb2a1:
+		bo, nanos = binary.BigEndian, true
+	case 0x0a0d0d0a:
+		return errors.Errorf("pcapng is not supported, convert with: editcap -F pcap in.pcapng out.pcap")
+	default:
+		return errors.Errorf("not a pcap file (magic %#08x)", magic)
+	}
+	linkType := bo.Uint32(hdr[20:24]) & 0xffff
+	klog.Infof("Replaying %s...", fname)
+	reasm := NewReassembler(*flagFragMaxSize, *flagFragTimeout)
+	numPackets, numLines := 0, 0
+	var rec [16]byte
+	var data []byte
+	for {
+		if _, err := io.ReadFull(r, rec[:]); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return errors.Annotatef(err, "failed to read pcap record")
+		}
+		sec, frac := int64(bo.Uint32(rec[0:4])), int64(bo.Uint32(rec[4:8]))
+		if !nanos {
+			frac *= 1000
+		}
+		ts := time.Unix(sec, frac)
+		capLen := bo.Uint32(rec[8:12])
+		if capLen > 256*1024 {
+			return errors.Errorf("invalid pcap record length %d", capLen)
+		}
+		if cap(data) < int(capLen) {
+			data = make([]byte, capLen)
+		}
+		data = data[:capLen]
+		if _, err := io.ReadFull(r, data); err != nil {
+			return errors.Annotatef(err, "failed to read pcap record")
+		}
+		src, dstPort, payload := pcapUDPPayload(linkType, data)
+		if payload == nil || (port != 0 && dstPort != port) {
+			continue
+		}
+		numPackets++
+		rxPackets.Add(1)
+		rxBytes.Add(int64(len(payload)))
+		authDevice, payload, ok := unwrapPayload(src, payload, true)
+		if !ok {
+			continue
+		}
+		if !checkPayloadLen(src, payload) {
+			continue
+		}
+		if pp, ok := parserFor(src).(logline.PacketParser); ok {
+			processPacket(pp, ts, src, "pcap", authDevice, payload)
+			continue
+		}
+		for _, line := range limitLines(src, reasm.Feed(ts, src, payload)) {
+			if err := processLine(ts, src, "pcap", authDevice, line); err != nil {
+				klog.Errorf("invalid log message %q: %v", string(line), err)
+			}
+			numLines++
+		}
+	}
+	reasm.Discard()
+	flushPending()
+	klog.Infof("Replayed %d lines from %d packets", numLines, numPackets)
+	return nil
+}
+
+// pcapUDPPayload extracts the source address, destination port and payload of a UDP packet.
+// Payload is nil if the frame does not contain a complete unfragmented UDP datagram.
+func pcapUDPPayload(linkType uint32, frame []byte) (*net.UDPAddr, int, []byte) {
+	var etherType uint16
+	var ip []byte
+	switch linkType {
+	case linkTypeEthernet:
+		if len(frame) < 14 {
+			return nil, 0, nil
+		}
+		etherType, ip = binary.BigEndian.Uint16(frame[12:14]), frame[14:]
+		// Skip VLAN tags.
+		for (etherType == 0x8100 || etherType == 0x88a8) && len(ip) >= 4 {
+			etherType, ip = binary.BigEndian.Uint16(ip[2:4]), ip[4:]
+		}
+	case linkTypeLinuxSLL:
+		if len(frame) < 16 {
+			return nil, 0, nil
+		}
+		etherType, ip = binary.BigEndian.Uint16(frame[14:16]), frame[16:]
+	case linkTypeNull:
+		// Address family in host byte order, only IP versions are of interest, those are checked below.
+		if len(frame) < 4 {
+			return nil, 0, nil
+		}
+		ip = frame[4:]
+	case linkTypeRaw, linkTypeIPv4, linkTypeIPv6:
+		ip = frame
+	default:
+		return nil, 0, nil
+	}
+	if len(ip) == 0 {
+		return nil, 0, nil
+	}
+	var srcIP net.IP
+	var udp []byte
+	switch {
+	case ip[0]>>4 == 4 && (etherType == 0 || etherType == 0x0800):
+		ihl := int(ip[0]&0x0f) * 4
+		if len(ip) < 20 || ihl < 20 || len(ip) < ihl || ip[9] != 17 {
+			return nil, 0, nil
+		}
+		// More fragments flag or non-zero offset.
+		if binary.BigEndian.Uint16(ip[6:8])&0x3fff != 0 {
+			return nil, 0, nil
+		}
+		srcIP, udp = net.IP(append([]byte(nil), ip[12:16]...)), ip[ihl:]
+	case ip[0]>>4 == 6 && (etherType == 0 || etherType == 0x86dd):
+		// Extension headers are not supported.
+		if len(ip) < 40 || ip[6] != 17 {
+			return nil, 0, nil
+		}
+		srcIP, udp = net.IP(append([]byte(nil), ip[8:24]...)), ip[40:]
+	default:
+		return nil, 0, nil
+	}
+	if len(udp) < 8 {
+		return nil, 0, nil
+	}
+	udpLen := int(binary.BigEndian.Uint16(udp[4:6]))
+	if udpLen < 8 || udpLen > len(udp) {
+		return nil, 0, nil
+	}
+	src := &net.UDPAddr{IP: srcIP, Port: int(binary.BigEndian.Uint16(udp[0:2]))}
+	return src, int(binary.BigEndian.Uint16(udp[2:4])), udp[8:udpLen]
+}
@@ -0,0 +1,65 @@
+/*
+ * Copyright (c) 2022 Deomid "rojer" Ryabkov
+ * All rights reserved
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"time"
+
+	klog "k8s.io/klog/v2"
+)
+
+type devicePresence struct {
+	lastSeen time.Time
+	src      string
+	online   bool
+}
+
+// updatePresenceLocked records activity of the device, reporting it online if it was silent.
+func (fm *FileManager) updatePresenceLocked(li *LineInfo) {
+	dp := fm.presence[li.DeviceID]
+	if dp == nil {
+		dp = &devicePresence{}
+		fm.presence[li.DeviceID] = dp
+	}
+	dp.lastSeen = time.Now()
+	dp.src = li.Src.String()
+	if !dp.online {
+		dp.online = true
+		onlineDevices.Add(1)
+		presenceEvents.Add("online", 1)
+		klog.Infof("Device %s is online (%s)", li.DeviceID, dp.src)
+	}
+}
+
+// presenceLoop reports devices that have not sent anything for longer than the offline timeout.
+func (fm *FileManager) presenceLoop() {
+	for now := range time.Tick(fm.offlineTimeout / 4) {
+		fm.mu.Lock()
+		for id, dp := range fm.presence {
+			if dp.online && now.Sub(dp.lastSeen) > fm.offlineTimeout {
+				dp.online = false
+				onlineDevices.Add(-1)
+				presenceEvents.Add("offline", 1)
+				klog.Infof("Device %s is offline (%s), last seen %s", id, dp.src, dp.lastSeen.Format(time.RFC3339))
+				// Forget it, will be re-added when it comes back.
+				delete(fm.presence, id)
+			}
+		}
+		fm.mu.Unlock()
+	}
+}
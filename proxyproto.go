@@ -0,0 +1,115 @@
+/*
+ * Copyright (c) 2022 Deomid "rojer" Ryabkov
+ * All rights reserved
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+var proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// readProxyHeader reads a PROXY protocol v1 or v2 header and returns the original source address.
+// Nil address is returned if the header does not carry one (v1 UNKNOWN, v2 LOCAL or non-IP families).
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	sig, err := r.Peek(len(proxyV2Sig))
+	if err != nil && !bytes.HasPrefix(sig, []byte("PROXY ")) {
+		return nil, errors.Annotatef(err, "failed to read PROXY header")
+	}
+	if bytes.Equal(sig, proxyV2Sig) {
+		return readProxyV2(r)
+	}
+	return readProxyV1(r)
+}
+
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	// The header is at most 107 bytes long, including CRLF.
+	line, err := r.ReadSlice('\n')
+	if err != nil || len(line) > 107 || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.Errorf("invalid PROXY v1 header")
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, errors.Errorf("invalid PROXY v1 header")
+	}
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil, nil
+	case "TCP4", "TCP6":
+		if len(fields) != 6 {
+			return nil, errors.Errorf("invalid PROXY v1 header")
+		}
+		ip := net.ParseIP(fields[2])
+		port, err := strconv.ParseUint(fields[4], 10, 16)
+		if ip == nil || err != nil {
+			return nil, errors.Errorf("invalid PROXY v1 source address")
+		}
+		return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+	default:
+		return nil, errors.Errorf("unsupported PROXY v1 protocol %q", fields[1])
+	}
+}
+
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, errors.Annotatef(err, "failed to read PROXY v2 header")
+	}
+	verCmd, fam := hdr[12], hdr[13]
+	addrs := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(r, addrs); err != nil {
+		return nil, errors.Annotatef(err, "failed to read PROXY v2 header")
+	}
+	if verCmd>>4 != 2 {
+		return nil, errors.Errorf("unsupported PROXY version %d", verCmd>>4)
+	}
+	// LOCAL command: health checks and such, the connection's own address is used.
+	if verCmd&0xf == 0 {
+		return nil, nil
+	}
+	switch fam >> 4 {
+	case 1: // AF_INET
+		if len(addrs) < 12 {
+			return nil, errors.Errorf("invalid PROXY v2 address length")
+		}
+		return &net.TCPAddr{IP: net.IP(addrs[0:4]), Port: int(binary.BigEndian.Uint16(addrs[8:10]))}, nil
+	case 2: // AF_INET6
+		if len(addrs) < 36 {
+			return nil, errors.Errorf("invalid PROXY v2 address length")
+		}
+		return &net.TCPAddr{IP: net.IP(addrs[0:16]), Port: int(binary.BigEndian.Uint16(addrs[32:34]))}, nil
+	}
+	return nil, nil
+}
+
+// bufConn is a connection with some of the input already buffered.
+type bufConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
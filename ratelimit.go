@@ -0,0 +1,100 @@
+/*
+ * Copyright (c) 2022 Deomid "rojer" Ryabkov
+ * All rights reserved
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	klog "k8s.io/klog/v2"
+)
+
+const rateLimitReportInterval = 10 * time.Second
+
+// RateLimiter limits the number of lines per second from each device using a token bucket.
+// Lines with level at or below exemptLevel are never dropped, but still consume tokens.
+// Bucket capacity is one second worth of lines, but at least one line.
+type RateLimiter struct {
+	rate        float64
+	capacity    float64
+	exemptLevel int
+	mu          sync.Mutex
+	devices     map[string]*bucket
+}
+
+type bucket struct {
+	deviceID string
+	tokens   float64
+	last     time.Time
+	dropped  uint64
+}
+
+func NewRateLimiter(rate float64, exemptLevel int) *RateLimiter {
+	rl := &RateLimiter{
+		rate:        rate,
+		capacity:    rate,
+		exemptLevel: exemptLevel,
+		devices:     make(map[string]*bucket),
+	}
+	if rl.capacity < 1 {
+		rl.capacity = 1
+	}
+	go rl.reportLoop()
+	return rl
+}
+
+// Allow returns true if the line should be processed.
+func (rl *RateLimiter) Allow(li *LineInfo) bool {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	now := li.Timestamp
+	b := rl.devices[li.DeviceIDSafe]
+	if b == nil {
+		b = &bucket{deviceID: li.DeviceID, tokens: rl.capacity, last: now}
+		rl.devices[li.DeviceIDSafe] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * rl.rate
+	if b.tokens > rl.capacity {
+		b.tokens = rl.capacity
+	}
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+	} else if int(li.Level) > rl.exemptLevel {
+		b.dropped++
+		return false
+	}
+	return true
+}
+
+// reportLoop periodically logs the number of dropped lines and forgets devices that have been idle.
+func (rl *RateLimiter) reportLoop() {
+	for now := range time.Tick(rateLimitReportInterval) {
+		rl.mu.Lock()
+		for id, b := range rl.devices {
+			if b.dropped > 0 {
+				klog.Warningf("Device %s: dropped %d lines", b.deviceID, b.dropped)
+				b.dropped = 0
+			} else if now.Sub(b.last) > rateLimitReportInterval && b.tokens+now.Sub(b.last).Seconds()*rl.rate >= rl.capacity {
+				// Bucket is full again, same as a new one.
+				delete(rl.devices, id)
+			}
+		}
+		rl.mu.Unlock()
+	}
+}
@@ -0,0 +1,112 @@
+/*
+ * Copyright (c) 2022 Deomid "rojer" Ryabkov
+ * All rights reserved
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"time"
+
+	klog "k8s.io/klog/v2"
+)
+
+// Reassembler splits packets into lines. A trailing fragment without a newline
+// is held and prepended to the next packet from the same source.
+type Reassembler struct {
+	maxSize   int
+	timeout   time.Duration
+	mu        sync.Mutex
+	frags     map[string]*fragment
+	lastSweep time.Time
+}
+
+type fragment struct {
+	data []byte
+	ts   time.Time
+}
+
+func NewReassembler(maxSize int, timeout time.Duration) *Reassembler {
+	return &Reassembler{
+		maxSize: maxSize,
+		timeout: timeout,
+		frags:   make(map[string]*fragment),
+	}
+}
+
+// Feed returns complete lines from the packet, line terminators are removed.
+// Returned slices are only valid until the next call.
+func (r *Reassembler) Feed(ts time.Time, src *net.UDPAddr, pkt []byte) [][]byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if ts.Sub(r.lastSweep) > r.timeout {
+		r.sweepLocked(ts)
+	}
+	key := src.String()
+	data := pkt
+	if f := r.frags[key]; f != nil {
+		delete(r.frags, key)
+		if ts.Sub(f.ts) > r.timeout {
+			dropFragment(key, f)
+		} else {
+			data = append(f.data, pkt...)
+		}
+	}
+	var lines [][]byte
+	for len(data) > 0 {
+		line, rest, found := bytes.Cut(data, []byte("\n"))
+		if !found {
+			if len(line) < r.maxSize {
+				r.frags[key] = &fragment{data: append([]byte(nil), line...), ts: ts}
+				break
+			}
+			// Too long to hold, let it through as is.
+			klog.V(1).Infof("%s: line too long (%d), not waiting for the rest", key, len(line))
+		}
+		if line = bytes.TrimRight(line, "\r"); len(line) > 0 {
+			lines = append(lines, line)
+		}
+		data = rest
+	}
+	return lines
+}
+
+// Discard drops all the held fragments, e.g. at the end of a capture.
+func (r *Reassembler) Discard() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for key, f := range r.frags {
+		dropFragment(key, f)
+		delete(r.frags, key)
+	}
+}
+
+func (r *Reassembler) sweepLocked(now time.Time) {
+	for key, f := range r.frags {
+		if now.Sub(f.ts) > r.timeout {
+			dropFragment(key, f)
+			delete(r.frags, key)
+		}
+	}
+	r.lastSweep = now
+}
+
+func dropFragment(key string, f *fragment) {
+	klog.V(1).Infof("%s: dropped incomplete fragment %q", key, f.data)
+	droppedFragments.Add(1)
+}
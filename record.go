@@ -0,0 +1,126 @@
+/*
+ * Copyright (c) 2022 Deomid "rojer" Ryabkov
+ * All rights reserved
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// RecordAssembler joins lines framed by explicit start and end markers
+// into a single record. The first line of a record provides its metadata
+// (sequence number, level, etc.), messages are joined with newlines.
+type RecordAssembler struct {
+	start    string
+	end      string
+	maxLines int
+	timeout  time.Duration
+	mu       sync.Mutex
+	pending  map[string]*pendingRecord
+}
+
+type pendingRecord struct {
+	li      *LineInfo
+	lines   []string
+	started time.Time
+}
+
+func NewRecordAssembler(start, end string, maxLines int, timeout time.Duration) *RecordAssembler {
+	return &RecordAssembler{
+		start:    start,
+		end:      end,
+		maxLines: maxLines,
+		timeout:  timeout,
+		pending:  make(map[string]*pendingRecord),
+	}
+}
+
+// Add feeds a line to the assembler and returns records that are ready to be written.
+// Lines outside of a record are returned as is.
+func (ra *RecordAssembler) Add(li *LineInfo) []*LineInfo {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	return ra.addLocked(li, ra.expireLocked(li.Timestamp))
+}
+
+func (ra *RecordAssembler) addLocked(li *LineInfo, res []*LineInfo) []*LineInfo {
+	pr := ra.pending[li.DeviceID]
+	if before, after, found := strings.Cut(li.Msg, ra.start); found {
+		if pr != nil {
+			// Previous record was never terminated, emit what we have.
+			res = append(res, ra.finishLocked(pr))
+		}
+		pr = &pendingRecord{li: li, started: li.Timestamp}
+		ra.pending[li.DeviceID] = pr
+		li.Msg = before + after
+	} else if pr == nil {
+		return append(res, li)
+	}
+	msg, rest, found := strings.Cut(li.Msg, ra.end)
+	var next *LineInfo
+	if rest = strings.TrimLeft(rest, " "); rest != "" {
+		// Text after the end marker starts the next record or is a line on its own.
+		nli := *li
+		nli.Msg = rest
+		next = &nli
+	}
+	pr.lines = append(pr.lines, strings.TrimRight(msg, " "))
+	if found || len(pr.lines) >= ra.maxLines {
+		res = append(res, ra.finishLocked(pr))
+	}
+	if next != nil {
+		res = ra.addLocked(next, res)
+	}
+	return res
+}
+
+func (ra *RecordAssembler) finishLocked(pr *pendingRecord) *LineInfo {
+	delete(ra.pending, pr.li.DeviceID)
+	pr.li.Msg = strings.Join(pr.lines, "\n")
+	return pr.li
+}
+
+// Records that have not been terminated within the timeout are emitted as is.
+func (ra *RecordAssembler) expireLocked(now time.Time) []*LineInfo {
+	var res []*LineInfo
+	for _, pr := range ra.pending {
+		if now.Sub(pr.started) > ra.timeout {
+			res = append(res, ra.finishLocked(pr))
+		}
+	}
+	return res
+}
+
+// Expired returns records that have not been terminated within the timeout.
+func (ra *RecordAssembler) Expired(now time.Time) []*LineInfo {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	return ra.expireLocked(now)
+}
+
+// Flush returns all the pending records, complete or not.
+func (ra *RecordAssembler) Flush() []*LineInfo {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	var res []*LineInfo
+	for _, pr := range ra.pending {
+		res = append(res, ra.finishLocked(pr))
+	}
+	return res
+}
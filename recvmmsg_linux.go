@@ -0,0 +1,127 @@
+//go:build linux
+
+/*
+ * Copyright (c) 2022 Deomid "rojer" Ryabkov
+ * All rights reserved
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"net"
+	"unsafe"
+
+	"github.com/juju/errors"
+	"golang.org/x/sys/unix"
+)
+
+// mmsghdr is struct mmsghdr, there is no definition in x/sys/unix.
+type mmsghdr struct {
+	hdr unix.Msghdr
+	len uint32
+}
+
+// receiveBatch is like receive, but reads up to batchSize datagrams per system call using recvmmsg.
+func receiveBatch(c *net.UDPConn, listener string, wp *WorkerPool, dropAcct bool, batchSize int) error {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	const oobSize = 64
+	msgs := make([]mmsghdr, batchSize)
+	bufs := make([]*[]byte, batchSize)
+	iovs := make([]unix.Iovec, batchSize)
+	names := make([]unix.RawSockaddrAny, batchSize)
+	var oob []byte
+	if dropAcct {
+		oob = make([]byte, oobSize*batchSize)
+	}
+	var lastKernelDrops uint32
+	for {
+		for i := range msgs {
+			if bufs[i] == nil {
+				bufs[i] = pktBufPool.Get().(*[]byte)
+			}
+			iovs[i].Base = &(*bufs[i])[0]
+			iovs[i].SetLen(len(*bufs[i]))
+			h := &msgs[i].hdr
+			*h = unix.Msghdr{Name: (*byte)(unsafe.Pointer(&names[i])), Namelen: unix.SizeofSockaddrAny, Iov: &iovs[i]}
+			h.SetIovlen(1)
+			if oob != nil {
+				h.Control = &oob[i*oobSize]
+				h.SetControllen(oobSize)
+			}
+		}
+		var n int
+		var serr error
+		err := rc.Read(func(fd uintptr) bool {
+			r, _, e := unix.Syscall6(unix.SYS_RECVMMSG, fd, uintptr(unsafe.Pointer(&msgs[0])), uintptr(len(msgs)), unix.MSG_DONTWAIT, 0, 0)
+			if e == unix.EAGAIN || e == unix.EWOULDBLOCK {
+				return false
+			}
+			n = int(r)
+			if e != 0 {
+				serr = e
+			}
+			return true
+		})
+		if err == nil {
+			err = serr
+		}
+		if err != nil {
+			for _, b := range bufs {
+				if b != nil {
+					pktBufPool.Put(b)
+				}
+			}
+			return errors.Annotatef(err, "socket read error")
+		}
+		for i := 0; i < n; i++ {
+			h := &msgs[i].hdr
+			if oob != nil && h.Controllen > 0 {
+				countKernelDrops(c, oob[i*oobSize:i*oobSize+int(h.Controllen)], &lastKernelDrops)
+			}
+			src := rawSockaddrToUDP(&names[i])
+			if src == nil {
+				continue
+			}
+			if isTruncated(int(h.Flags)) {
+				countTruncated(src)
+			}
+			enqueueDatagram(bufs[i], int(msgs[i].len), src, listener, wp)
+			bufs[i] = nil
+		}
+	}
+}
+
+func rawSockaddrToUDP(rsa *unix.RawSockaddrAny) *net.UDPAddr {
+	switch rsa.Addr.Family {
+	case unix.AF_INET:
+		sa := (*unix.RawSockaddrInet4)(unsafe.Pointer(rsa))
+		p := (*[2]byte)(unsafe.Pointer(&sa.Port))
+		return &net.UDPAddr{IP: net.IPv4(sa.Addr[0], sa.Addr[1], sa.Addr[2], sa.Addr[3]), Port: int(p[0])<<8 | int(p[1])}
+	case unix.AF_INET6:
+		sa := (*unix.RawSockaddrInet6)(unsafe.Pointer(rsa))
+		p := (*[2]byte)(unsafe.Pointer(&sa.Port))
+		addr := &net.UDPAddr{IP: append(net.IP(nil), sa.Addr[:]...), Port: int(p[0])<<8 | int(p[1])}
+		if sa.Scope_id != 0 {
+			if ifi, err := net.InterfaceByIndex(int(sa.Scope_id)); err == nil {
+				addr.Zone = ifi.Name
+			}
+		}
+		return addr
+	}
+	return nil
+}
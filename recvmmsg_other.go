@@ -0,0 +1,27 @@
+//go:build !linux
+
+/*
+ * Copyright (c) 2022 Deomid "rojer" Ryabkov
+ * All rights reserved
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import "net"
+
+// receiveBatch falls back to reading one datagram at a time, recvmmsg is only available on Linux.
+func receiveBatch(c *net.UDPConn, listener string, wp *WorkerPool, dropAcct bool, batchSize int) error {
+	return receive(c, listener, wp, dropAcct)
+}
@@ -0,0 +1,171 @@
+/*
+ * Copyright (c) 2022 Deomid "rojer" Ryabkov
+ * All rights reserved
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// Reorderer holds lines of each device for a short time and releases them ordered by sequence number.
+type Reorderer struct {
+	window   time.Duration
+	maxLines int
+	mu       sync.Mutex
+	devices  map[string]*reorderBuf
+}
+
+type reorderBuf struct {
+	lines     lineHeap
+	maxSeq    uint64
+	maxUptime uint64
+	// Arrival time of the oldest line in the buffer, may be older if lines were released since.
+	oldest time.Time
+}
+
+const (
+	// Sequence number going back by more than this means the device rebooted.
+	rebootSeqGap = 1000
+	// Uptime going back by more than this means the device rebooted,
+	// where there is no reorder window to go by.
+	rebootTolerance = 10 * time.Second
+)
+
+// isReboot returns true if the line must have been sent after a reboot of the device,
+// given the highest sequence number and uptime seen from it so far.
+// Lines that arrive late also have lower sequence number and uptime,
+// so uptime has to go back by more than tolerance or sequence number by more than rebootSeqGap.
+func isReboot(li *LineInfo, maxSeq, maxUptime uint64, tolerance time.Duration) bool {
+	if li.SeqNum >= maxSeq {
+		return false
+	}
+	return li.UptimeMs+uint64(tolerance.Milliseconds()) < maxUptime || li.SeqNum+rebootSeqGap < maxSeq
+}
+
+type lineHeap []*LineInfo
+
+func (h lineHeap) Len() int            { return len(h) }
+func (h lineHeap) Less(i, j int) bool  { return h[i].SeqNum < h[j].SeqNum }
+func (h lineHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *lineHeap) Push(x interface{}) { *h = append(*h, x.(*LineInfo)) }
+func (h *lineHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	li := old[n-1]
+	*h = old[:n-1]
+	return li
+}
+
+func NewReorderer(window time.Duration, maxLines int) *Reorderer {
+	return &Reorderer{
+		window:   window,
+		maxLines: maxLines,
+		devices:  make(map[string]*reorderBuf),
+	}
+}
+
+// Add buffers the line and returns lines that are ready to be written, if any.
+func (ro *Reorderer) Add(li *LineInfo) []*LineInfo {
+	ro.mu.Lock()
+	defer ro.mu.Unlock()
+	rb := ro.devices[li.DeviceID]
+	if rb == nil {
+		rb = &reorderBuf{}
+		ro.devices[li.DeviceID] = rb
+	}
+	var res []*LineInfo
+	// Lines from before the reboot go first.
+	if isReboot(li, rb.maxSeq, rb.maxUptime, ro.window) {
+		for rb.lines.Len() > 0 {
+			res = append(res, rb.pop())
+		}
+		rb.maxSeq, rb.maxUptime = 0, 0
+	}
+	if li.SeqNum > rb.maxSeq {
+		rb.maxSeq = li.SeqNum
+	}
+	if li.UptimeMs > rb.maxUptime {
+		rb.maxUptime = li.UptimeMs
+	}
+	if rb.lines.Len() == 0 || li.Timestamp.Before(rb.oldest) {
+		rb.oldest = li.Timestamp
+	}
+	heap.Push(&rb.lines, li)
+	for rb.lines.Len() > ro.maxLines {
+		res = append(res, rb.pop())
+	}
+	return res
+}
+
+func (rb *reorderBuf) pop() *LineInfo {
+	return heap.Pop(&rb.lines).(*LineInfo)
+}
+
+// Expired returns lines that have been held for longer than the window, in order.
+// Buffers of devices with no lines left are removed.
+func (ro *Reorderer) Expired(now time.Time) []*LineInfo {
+	ro.mu.Lock()
+	defer ro.mu.Unlock()
+	var res []*LineInfo
+	for id, rb := range ro.devices {
+		if rb.lines.Len() > 0 && now.Sub(rb.oldest) >= ro.window {
+			res = rb.releaseExpired(now, ro.window, res)
+		}
+		if rb.lines.Len() == 0 {
+			delete(ro.devices, id)
+		}
+	}
+	return res
+}
+
+// releaseExpired appends expired lines to res.
+// A line cannot be released before those with lower sequence numbers,
+// so lines are released in order up to the highest sequence number of the expired ones.
+func (rb *reorderBuf) releaseExpired(now time.Time, window time.Duration, res []*LineInfo) []*LineInfo {
+	var maxSeq uint64
+	found := false
+	for _, li := range rb.lines {
+		if now.Sub(li.Timestamp) >= window && (!found || li.SeqNum > maxSeq) {
+			maxSeq, found = li.SeqNum, true
+		}
+	}
+	for found && rb.lines.Len() > 0 && rb.lines[0].SeqNum <= maxSeq {
+		res = append(res, rb.pop())
+	}
+	for i, li := range rb.lines {
+		if i == 0 || li.Timestamp.Before(rb.oldest) {
+			rb.oldest = li.Timestamp
+		}
+	}
+	return res
+}
+
+// Flush returns all the buffered lines.
+func (ro *Reorderer) Flush() []*LineInfo {
+	ro.mu.Lock()
+	defer ro.mu.Unlock()
+	var res []*LineInfo
+	for id, rb := range ro.devices {
+		for rb.lines.Len() > 0 {
+			res = append(res, rb.pop())
+		}
+		delete(ro.devices, id)
+	}
+	return res
+}
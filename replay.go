@@ -0,0 +1,81 @@
+/*
+ * Copyright (c) 2022 Deomid "rojer" Ryabkov
+ * All rights reserved
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	"github.com/juju/errors"
+	klog "k8s.io/klog/v2"
+)
+
+// Source address reported for replayed lines.
+var replaySrc = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+
+// replayFile processes log lines from a file, one per line, as if they were received over UDP.
+func replayFile(fname string) error {
+	f, err := os.Open(fname)
+	if err != nil {
+		return errors.Annotatef(err, "failed to open replay file")
+	}
+	defer f.Close()
+	klog.Infof("Replaying %s...", fname)
+	return replayLines(f, "replay")
+}
+
+// replayLines processes log lines from r until EOF.
+// Lines are reported as received on the listener with the specified tag.
+func replayLines(r io.Reader, listener string) error {
+	var err error
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, 1024*1024)
+	numLines := 0
+	var lj *lineJoiner
+	if *flagJoinCont {
+		lj = &lineJoiner{listener: listener}
+	}
+	for sc.Scan() {
+		line := bytes.TrimRight(sc.Bytes(), "\r")
+		if len(line) == 0 {
+			continue
+		}
+		if lj != nil {
+			err = lj.Add(time.Now(), replaySrc, line)
+		} else {
+			err = processLine(time.Now(), replaySrc, listener, "", line)
+		}
+		if err != nil {
+			klog.Errorf("invalid log message %q: %v", string(line), err)
+		}
+		numLines++
+	}
+	if err := sc.Err(); err != nil {
+		return errors.Annotatef(err, "read error")
+	}
+	if lj != nil {
+		lj.Flush()
+	}
+	flushPending()
+	klog.Infof("Replayed %d lines", numLines)
+	return nil
+}
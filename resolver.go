@@ -0,0 +1,107 @@
+/*
+ * Copyright (c) 2022 Deomid "rojer" Ryabkov
+ * All rights reserved
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"container/list"
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	klog "k8s.io/klog/v2"
+)
+
+const (
+	resolveTimeout     = 5 * time.Second
+	resolveCacheSize   = 4096 // Least recently seen addresses are evicted.
+	resolveConcurrency = 8
+)
+
+// SrcResolver resolves source addresses to host names in the background and caches the results.
+type SrcResolver struct {
+	ttl   time.Duration
+	sem   chan struct{} // Limits the number of lookups in flight.
+	mu    sync.Mutex
+	cache map[string]*list.Element // Elements of lru.
+	lru   list.List                // *hostEntry, most recently used first.
+}
+
+type hostEntry struct {
+	ip      string
+	host    string
+	expires time.Time
+	pending bool
+}
+
+func NewSrcResolver(ttl time.Duration) *SrcResolver {
+	return &SrcResolver{
+		ttl:   ttl,
+		sem:   make(chan struct{}, resolveConcurrency),
+		cache: make(map[string]*list.Element),
+	}
+}
+
+// Lookup returns the host name of the address if known, otherwise the address itself.
+// It never blocks, lookups are performed asynchronously.
+func (r *SrcResolver) Lookup(ip net.IP) string {
+	ipStr := ip.String()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	el := r.cache[ipStr]
+	if el == nil {
+		el = r.lru.PushFront(&hostEntry{ip: ipStr, host: ipStr})
+		r.cache[ipStr] = el
+		if r.lru.Len() > resolveCacheSize {
+			delete(r.cache, r.lru.Remove(r.lru.Back()).(*hostEntry).ip)
+		}
+	} else {
+		r.lru.MoveToFront(el)
+	}
+	he := el.Value.(*hostEntry)
+	if !he.pending && time.Now().After(he.expires) {
+		select {
+		case r.sem <- struct{}{}:
+			he.pending = true
+			go r.resolve(he)
+		default:
+			// Too many lookups in flight, try again next time.
+		}
+	}
+	return he.host
+}
+
+func (r *SrcResolver) resolve(he *hostEntry) {
+	defer func() { <-r.sem }()
+	ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+	defer cancel()
+	ipStr := he.ip
+	host := ipStr
+	if names, err := net.DefaultResolver.LookupAddr(ctx, ipStr); err == nil && len(names) > 0 {
+		host = strings.TrimSuffix(names[0], ".")
+		klog.V(1).Infof("%s is %s", ipStr, host)
+	} else {
+		klog.V(1).Infof("Failed to resolve %s: %v", ipStr, err)
+	}
+	r.mu.Lock()
+	he.host = host
+	he.expires = time.Now().Add(r.ttl)
+	he.pending = false
+	r.mu.Unlock()
+}
@@ -0,0 +1,157 @@
+/*
+ * Copyright (c) 2022 Deomid "rojer" Ryabkov
+ * All rights reserved
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/juju/errors"
+	klog "k8s.io/klog/v2"
+)
+
+const retentionSweepInterval = time.Hour
+
+// Placeholders used to turn a file name template into a regexp.
+const (
+	phAny   = "\x00"
+	phYear  = "\x01"
+	phMonth = "\x02"
+	phDay   = "\x03"
+)
+
+// setStrings sets all the string fields of a struct, including embedded ones.
+func setStrings(v reflect.Value, s string) {
+	for i := 0; i < v.NumField(); i++ {
+		switch f := v.Field(i); {
+		case f.Kind() == reflect.String:
+			f.SetString(s)
+		case f.Kind() == reflect.Struct && v.Type().Field(i).Anonymous:
+			setStrings(f, s)
+		}
+	}
+}
+
+// nameTmplRegexp builds a regexp that matches file names produced by the template.
+// Year, month and day are captured, in that order.
+func nameTmplRegexp(t *template.Template) (*regexp.Regexp, error) {
+	li := &LineInfo{}
+	setStrings(reflect.ValueOf(li).Elem(), phAny)
+	li.Year, li.Month, li.Day = phYear, phMonth, phDay
+	name, err := execTmpl(t, li)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	yi, mi, di := strings.Index(name, phYear), strings.Index(name, phMonth), strings.Index(name, phDay)
+	if yi < 0 || mi < 0 || di < 0 || yi > mi || mi > di {
+		return nil, errors.Errorf("file name must contain .Year, .Month and .Day, in that order")
+	}
+	var sb strings.Builder
+	sb.WriteString("^")
+	for _, c := range name {
+		switch s := string(c); s {
+		case phAny:
+			sb.WriteString(".*")
+		case phYear:
+			sb.WriteString(`(\d{4})`)
+		case phMonth, phDay:
+			sb.WriteString(`(\d{2})`)
+		default:
+			sb.WriteString(regexp.QuoteMeta(s))
+		}
+	}
+	sb.WriteString("$")
+	return regexp.Compile(sb.String())
+}
+
+func (fm *FileManager) retentionLoop() {
+	for {
+		fm.sweepOldFiles()
+		time.Sleep(retentionSweepInterval)
+	}
+}
+
+// sweepOldFiles removes log files with dates older than the retention period.
+// Files that are open and targets of the "latest" symlinks are never removed.
+func (fm *FileManager) sweepOldFiles() {
+	keep := make(map[string]bool)
+	fm.mu.Lock()
+	nameRE := fm.nameRE
+	for _, di := range fm.allFilesLocked() {
+		if di.fd != nil {
+			keep[filepath.Clean(di.fname)] = true
+		}
+	}
+	fm.mu.Unlock()
+	cutoff := time.Now().Add(-fm.retention)
+	var candidates []string
+	filepath.WalkDir(fm.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		switch {
+		case d.Type()&fs.ModeSymlink != 0:
+			if target, err := os.Readlink(path); err == nil {
+				if !filepath.IsAbs(target) {
+					target = filepath.Join(filepath.Dir(path), target)
+				}
+				keep[filepath.Clean(target)] = true
+			}
+		case d.Type().IsRegular():
+			m := nameRE.FindStringSubmatch(path)
+			if m == nil {
+				break
+			}
+			y, _ := strconv.Atoi(m[1])
+			mon, _ := strconv.Atoi(m[2])
+			day, _ := strconv.Atoi(m[3])
+			// The file is complete at the end of the day.
+			if time.Date(y, time.Month(mon), day+1, 0, 0, 0, 0, time.Local).Before(cutoff) {
+				candidates = append(candidates, filepath.Clean(path))
+			}
+		}
+		return nil
+	})
+	numFiles, numBytes := 0, int64(0)
+	for _, path := range candidates {
+		if keep[path] {
+			continue
+		}
+		st, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			klog.Errorf("Failed to remove %s: %v", path, err)
+			continue
+		}
+		klog.V(1).Infof("Removed %s", path)
+		numFiles++
+		numBytes += st.Size()
+	}
+	if numFiles > 0 {
+		klog.Infof("Retention: removed %d files, %d bytes", numFiles, numBytes)
+	}
+}
@@ -0,0 +1,64 @@
+//go:build linux
+
+/*
+ * Copyright (c) 2022 Deomid "rojer" Ryabkov
+ * All rights reserved
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"net"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// enableRxqOvfl makes the kernel report the number of packets dropped
+// due to receive buffer overflow with each received packet.
+func enableRxqOvfl(c *net.UDPConn) error {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_RXQ_OVFL, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+// parseRxqOvfl extracts the socket's cumulative drop counter from control messages.
+func parseRxqOvfl(oob []byte) (uint32, bool) {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0, false
+	}
+	for _, m := range msgs {
+		if m.Header.Level == unix.SOL_SOCKET && m.Header.Type == unix.SO_RXQ_OVFL && len(m.Data) >= 4 {
+			// Native byte order.
+			return *(*uint32)(unsafe.Pointer(&m.Data[0])), true
+		}
+	}
+	return 0, false
+}
+
+// isTruncated returns true if the received message flags indicate that the datagram did not fit in the buffer.
+func isTruncated(flags int) bool {
+	return flags&unix.MSG_TRUNC != 0
+}
@@ -0,0 +1,38 @@
+//go:build !linux
+
+/*
+ * Copyright (c) 2022 Deomid "rojer" Ryabkov
+ * All rights reserved
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"net"
+
+	"github.com/juju/errors"
+)
+
+func enableRxqOvfl(c *net.UDPConn) error {
+	return errors.New("not supported on this platform")
+}
+
+func parseRxqOvfl(oob []byte) (uint32, bool) {
+	return 0, false
+}
+
+func isTruncated(flags int) bool {
+	return false
+}
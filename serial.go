@@ -0,0 +1,98 @@
+/*
+ * Copyright (c) 2022 Deomid "rojer" Ryabkov
+ * All rights reserved
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/rojer/mos_udp_log_catcher/logline"
+	klog "k8s.io/klog/v2"
+)
+
+// serialInput reads console output from a serial port.
+// The output is not in the log line format, so each line is logged as an info message.
+type serialInput struct {
+	f        *os.File
+	deviceID string
+	tag      string
+	opened   time.Time
+}
+
+// openSerial opens and configures the serial port, spec is /dev/ttyXXX:baudrate.
+func openSerial(spec, deviceID string) (*serialInput, error) {
+	path, baudStr, found := strings.Cut(spec, ":")
+	if !found {
+		return nil, errors.Errorf("baud rate is required, e.g. %s:115200", spec)
+	}
+	baud, err := strconv.Atoi(baudStr)
+	if err != nil || baud <= 0 {
+		return nil, errors.Errorf("invalid baud rate %q", baudStr)
+	}
+	if deviceID == "" {
+		deviceID = filepath.Base(path)
+	}
+	f, err := openSerialPort(path, baud)
+	if err != nil {
+		return nil, errors.Annotatef(err, "failed to open %s", path)
+	}
+	klog.Infof("Reading from %s at %d baud...", path, baud)
+	return &serialInput{f: f, deviceID: deviceID, tag: "serial:" + path, opened: time.Now()}, nil
+}
+
+func (in *serialInput) Run(wp *WorkerPool) error {
+	sc := bufio.NewScanner(in.f)
+	sc.Buffer(nil, maxStreamLineLen)
+	var seq uint64
+	for sc.Scan() {
+		line := bytes.TrimRight(sc.Bytes(), "\r")
+		if len(line) == 0 {
+			continue
+		}
+		rxBytes.Add(int64(len(sc.Bytes()) + 1))
+		now := time.Now()
+		wp.EnqueueWait(&packet{
+			ts:  now,
+			src: unixSrc,
+			li: &logline.LineInfo{
+				DeviceID: in.deviceID,
+				SeqNum:   seq,
+				UptimeMs: uint64(now.Sub(in.opened).Milliseconds()),
+				FD:       1,
+				Level:    2,
+				Msg:      string(line),
+			},
+			listener: in.tag,
+		})
+		seq++
+	}
+	if err := sc.Err(); err != nil {
+		return errors.Annotatef(err, "serial read error")
+	}
+	return errors.Errorf("serial port closed")
+}
+
+func (in *serialInput) Close() error {
+	return in.f.Close()
+}
@@ -0,0 +1,296 @@
+/*
+ * Copyright (c) 2022 Deomid "rojer" Ryabkov
+ * All rights reserved
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	klog "k8s.io/klog/v2"
+)
+
+// Sink is a destination for log lines: stdout, log files, a remote collector, etc.
+type Sink interface {
+	WriteLine(li *LineInfo)
+	Close() error
+}
+
+// outputSink is a configured sink with its own filter.
+type outputSink struct {
+	Sink
+	name      string
+	devFilter *DeviceFilter
+	minLevel  int  // -1 = all levels.
+	keepANSI  bool // Receives messages as they were before --strip-ansi.
+}
+
+var (
+	sinks          []*outputSink
+	closeSinksOnce sync.Once
+)
+
+// Write passes the line to the sink if it is accepted by the filter.
+func (s *outputSink) Write(li *LineInfo) {
+	if s.minLevel >= 0 && li.Level > uint(s.minLevel) {
+		return
+	}
+	if s.devFilter != nil && s.devFilter.Check(li.DeviceID) != "" {
+		return
+	}
+	s.WriteLine(li)
+}
+
+// closeSinks flushes and closes all the sinks, it is safe to call more than once.
+func closeSinks() {
+	closeSinksOnce.Do(func() {
+		for _, s := range sinks {
+			if err := s.Close(); err != nil {
+				klog.Errorf("Failed to close %s: %v", s.name, err)
+			}
+		}
+	})
+}
+
+// stdoutSink writes lines to stdout according to --stdout-format, with colors if enabled.
+type stdoutSink struct{}
+
+func (stdoutSink) WriteLine(li *LineInfo) {
+	stdoutFmt := getDynConfig().stdoutFmt
+	if stdoutFmt == nil {
+		return
+	}
+	rec, err := stdoutFmt.Format(li)
+	if err != nil {
+		klog.Errorf("Failed to format stdout record: %v", err)
+		return
+	}
+	rec = trimRecordSep(rec, recordSep)
+	if lc := levelColors[li.LevelChar]; color && lc != "" {
+		rec = lc + rec + colorReset
+	}
+	stdoutMu.Lock()
+	os.Stdout.WriteString(rec + recordSep)
+	stdoutMu.Unlock()
+}
+
+func (stdoutSink) Close() error {
+	return nil
+}
+
+// newOutputSink creates a sink from a --sink spec:
+// stdout:, file:///path, udp://host:port or tcp://host:port, with optional parameters
+// format (template, json or logfmt, --stdout-format by default), min-level, allow-devices and deny-devices.
+func newOutputSink(spec string) (*outputSink, error) {
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	q := u.Query()
+	rs := &recordSink{name: spec, mu: &sync.Mutex{}}
+	format := *flagStdoutFormat
+	if q.Has("format") {
+		format = q.Get("format")
+	}
+	if rs.format, err = parseRecordFormat(spec, format); err != nil {
+		return nil, errors.Annotatef(err, "invalid format")
+	}
+	switch u.Scheme {
+	case "stdout":
+		rs.w, rs.mu = os.Stdout, &stdoutMu
+	case "file":
+		fname := u.Path
+		if u.Opaque != "" {
+			fname = u.Opaque
+		}
+		mode, err := parseFileMode(*flagFileMode)
+		if err != nil {
+			return nil, errors.Annotatef(err, "invalid --file-mode")
+		}
+		f, err := os.OpenFile(fname, os.O_APPEND|os.O_CREATE|os.O_WRONLY, mode)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		rs.w, rs.c = f, f
+	case "udp", "udp4", "udp6", "tcp", "tcp4", "tcp6":
+		if u.Host == "" {
+			return nil, errors.Errorf("address is required")
+		}
+		nw := newNetWriter(spec, u.Scheme, u.Host)
+		rs.w, rs.c = nw, nw
+	default:
+		return nil, errors.Errorf("unsupported sink type %q", u.Scheme)
+	}
+	s := &outputSink{Sink: rs, name: spec, minLevel: -1}
+	if q.Has("min-level") {
+		if s.minLevel, err = strconv.Atoi(q.Get("min-level")); err != nil {
+			return nil, errors.Errorf("invalid min-level %q", q.Get("min-level"))
+		}
+	}
+	if q.Has("allow-devices") || q.Has("deny-devices") {
+		var allow, deny []string
+		if v := q.Get("allow-devices"); v != "" {
+			allow = strings.Split(v, ",")
+		}
+		if v := q.Get("deny-devices"); v != "" {
+			deny = strings.Split(v, ",")
+		}
+		if s.devFilter, err = NewDeviceFilter(allow, deny); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	klog.Infof("Writing lines to %s", u.Redacted())
+	return s, nil
+}
+
+// recordSink writes formatted records to a file or a network connection.
+type recordSink struct {
+	name   string
+	format recordFormat
+	mu     *sync.Mutex
+	w      io.Writer
+	c      io.Closer // May be nil.
+}
+
+func (rs *recordSink) WriteLine(li *LineInfo) {
+	rec, err := rs.format.Format(li)
+	if err != nil {
+		klog.Errorf("Failed to format record for %s: %v", rs.name, err)
+		return
+	}
+	rec = trimRecordSep(rec, recordSep) + recordSep
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if _, err := io.WriteString(rs.w, rec); err != nil {
+		sinkErrors.Add(rs.name, 1)
+		klog.V(1).Infof("Failed to write to %s: %v", rs.name, err)
+	}
+}
+
+func (rs *recordSink) Close() error {
+	if rs.c == nil {
+		return nil
+	}
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return rs.c.Close()
+}
+
+const (
+	netSinkRetryInterval = 5 * time.Second
+	netSinkWriteTimeout  = 5 * time.Second
+	netSinkQueueLen      = 1024
+)
+
+// netWriter sends data to a network address, reconnecting after errors.
+// Writes are queued and sent by a separate goroutine so a slow or unreachable collector
+// does not hold up the workers; when the queue is full, data is dropped.
+// While the address is unreachable, sends fail without trying to connect again for a while.
+type netWriter struct {
+	name     string
+	network  string
+	addr     string
+	c        net.Conn
+	lastFail time.Time
+
+	mu     sync.Mutex
+	closed bool
+	q      chan []byte
+	done   chan struct{}
+}
+
+func newNetWriter(name, network, addr string) *netWriter {
+	nw := &netWriter{
+		name:    name,
+		network: network,
+		addr:    addr,
+		q:       make(chan []byte, netSinkQueueLen),
+		done:    make(chan struct{}),
+	}
+	go nw.run()
+	return nw
+}
+
+func (nw *netWriter) Write(b []byte) (int, error) {
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+	if nw.closed {
+		return 0, errors.Errorf("closed")
+	}
+	select {
+	case nw.q <- append([]byte(nil), b...):
+	default:
+		sinkDropped.Add(nw.name, 1)
+		klog.V(1).Infof("Queue for %s is full, dropping data", nw.name)
+	}
+	return len(b), nil
+}
+
+func (nw *netWriter) run() {
+	defer close(nw.done)
+	for b := range nw.q {
+		if err := nw.send(b); err != nil {
+			sinkErrors.Add(nw.name, 1)
+			klog.V(1).Infof("Failed to write to %s: %v", nw.name, err)
+		}
+	}
+	if nw.c != nil {
+		nw.c.Close()
+		nw.c = nil
+	}
+}
+
+func (nw *netWriter) send(b []byte) error {
+	if nw.c == nil {
+		if time.Since(nw.lastFail) < netSinkRetryInterval {
+			return errors.Errorf("not connected")
+		}
+		c, err := net.DialTimeout(nw.network, nw.addr, netSinkRetryInterval)
+		if err != nil {
+			nw.lastFail = time.Now()
+			return errors.Trace(err)
+		}
+		nw.c = c
+	}
+	nw.c.SetWriteDeadline(time.Now().Add(netSinkWriteTimeout))
+	if _, err := nw.c.Write(b); err != nil {
+		nw.c.Close()
+		nw.c = nil
+		nw.lastFail = time.Now()
+		return errors.Trace(err)
+	}
+	return nil
+}
+
+// Close sends the remaining queued data and closes the connection.
+func (nw *netWriter) Close() error {
+	nw.mu.Lock()
+	if !nw.closed {
+		nw.closed = true
+		close(nw.q)
+	}
+	nw.mu.Unlock()
+	<-nw.done
+	return nil
+}
@@ -0,0 +1,113 @@
+/*
+ * Copyright (c) 2022 Deomid "rojer" Ryabkov
+ * All rights reserved
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"expvar"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/rojer/mos_udp_log_catcher/logline"
+	klog "k8s.io/klog/v2"
+)
+
+var (
+	droppedLines         = expvar.NewMap("dropped_lines")
+	droppedFragments     = expvar.NewInt("dropped_fragments")
+	droppedPackets       = expvar.NewInt("dropped_packets")
+	kernelDroppedPackets = expvar.NewInt("kernel_dropped_packets") // Receive buffer overflows.
+	truncatedPackets     = expvar.NewInt("truncated_packets")      // Larger than --max-packet-size.
+	limitExceeded        = expvar.NewMap("limit_exceeded")         // Data dropped due to --max-payload-size and --max-packet-lines.
+	rxPackets            = expvar.NewInt("rx_packets")
+	rxBytes              = expvar.NewInt("rx_bytes")
+	parsedLines          = expvar.NewInt("parsed_lines")
+	parseErrors          = expvar.NewInt("parse_errors")
+	truncatedLines       = expvar.NewInt("truncated_lines") // Longer than --max-msg-len.
+	malformedLines       = expvar.NewMap("malformed_lines")
+	quarantinedLines     = expvar.NewInt("quarantined_lines")
+	rejectedErrorLines   = expvar.NewInt("error_file_rejected_lines")
+	onlineDevices        = expvar.NewInt("online_devices")
+	presenceEvents       = expvar.NewMap("presence_events")
+	mirrorErrors         = expvar.NewInt("mirror_errors")
+	sinkErrors           = expvar.NewMap("sink_errors")  // Failed writes, by --sink spec.
+	sinkDropped          = expvar.NewMap("sink_dropped") // Not written because the queue was full, by --sink spec.
+	decompressErrors     = expvar.NewInt("decompress_errors")
+	badHMACPackets       = expvar.NewInt("bad_hmac_packets")
+	rejectedPackets      = expvar.NewMap("rejected_packets") // Encrypted packet errors, by reason.
+
+	// Devices seen since the last stats tick, only tracked if stats logging is enabled.
+	activeDevsMu sync.Mutex
+	activeDevs   map[string]bool
+)
+
+// countDrop accounts for a line that was parsed successfully but not written out.
+func countDrop(li *LineInfo, reason string) {
+	droppedLines.Add(reason, 1)
+	klog.V(1).Infof("Dropped line from %s (%s), %s total", li.DeviceID, reason, droppedLines.Get(reason))
+}
+
+// countParseError accounts for a line that could not be parsed and records it in the error file.
+func countParseError(ts time.Time, src *net.UDPAddr, line []byte, err error) {
+	parseErrors.Add(1)
+	reason := parseErrorReason(err)
+	malformedLines.Add(reason, 1)
+	if errFile != nil {
+		errFile.Write(ts, src, line, reason, err)
+	}
+}
+
+// parseErrorReason returns a short identifier of the parse error, e.g. "num_parts".
+func parseErrorReason(err error) string {
+	if pe, ok := errors.Cause(err).(*logline.Error); ok {
+		return pe.Reason
+	}
+	return "other"
+}
+
+func countActiveDevice(li *LineInfo) {
+	activeDevsMu.Lock()
+	if activeDevs != nil {
+		activeDevs[li.DeviceID] = true
+	}
+	activeDevsMu.Unlock()
+}
+
+// statsLoop periodically logs traffic counters and rates since the previous tick.
+func statsLoop(interval time.Duration) {
+	activeDevsMu.Lock()
+	activeDevs = make(map[string]bool)
+	activeDevsMu.Unlock()
+	var lastPackets, lastBytes, lastLines int64
+	lastTick := time.Now()
+	for now := range time.Tick(interval) {
+		activeDevsMu.Lock()
+		numDevs := len(activeDevs)
+		activeDevs = make(map[string]bool)
+		activeDevsMu.Unlock()
+		packets, bytes, lines := rxPackets.Value(), rxBytes.Value(), parsedLines.Value()
+		secs := now.Sub(lastTick).Seconds()
+		klog.Infof("Stats: %d packets (%.1f/s), %d bytes (%.1f/s), %d lines (%.1f/s), %d parse errors, %d kernel drops, %d active devices",
+			packets, float64(packets-lastPackets)/secs,
+			bytes, float64(bytes-lastBytes)/secs,
+			lines, float64(lines-lastLines)/secs,
+			parseErrors.Value(), kernelDroppedPackets.Value(), numDevs)
+		lastPackets, lastBytes, lastLines, lastTick = packets, bytes, lines, now
+	}
+}
@@ -0,0 +1,120 @@
+/*
+ * Copyright (c) 2022 Deomid "rojer" Ryabkov
+ * All rights reserved
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/juju/errors"
+	klog "k8s.io/klog/v2"
+)
+
+// First file descriptor passed by systemd, SD_LISTEN_FDS_START.
+const sdListenFDsStart = 3
+
+// Sockets passed by systemd, used ones are set to nil.
+var (
+	sdSockets       []*os.File
+	sdSocketsLoaded bool
+)
+
+// sdListenFDs returns the sockets passed by systemd socket activation, see sd_listen_fds(3).
+// Environment variables are unset so they are not inherited by child processes.
+func sdListenFDs() []*os.File {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	var files []*os.File
+	for i := 0; i < n; i++ {
+		fd := sdListenFDsStart + i
+		name := "LISTEN_FD_" + strconv.Itoa(fd)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		files = append(files, os.NewFile(uintptr(fd), name))
+	}
+	return files
+}
+
+// openSystemdInputs creates inputs for the sockets passed by systemd.
+// If name is not empty, only sockets with this FileDescriptorName= are used.
+func openSystemdInputs(name, tag string) ([]inputSource, error) {
+	if !sdSocketsLoaded {
+		sdSockets, sdSocketsLoaded = sdListenFDs(), true
+	}
+	var res []inputSource
+	for i, f := range sdSockets {
+		if f == nil || (name != "" && f.Name() != name) {
+			continue
+		}
+		sdSockets[i] = nil
+		in, err := systemdInput(f, tag)
+		f.Close()
+		if err != nil {
+			for _, in := range res {
+				in.Close()
+			}
+			return nil, errors.Trace(err)
+		}
+		res = append(res, in)
+	}
+	if len(res) == 0 {
+		if name != "" {
+			return nil, errors.Errorf("no socket named %q was passed by systemd", name)
+		}
+		return nil, errors.Errorf("no sockets were passed by systemd (LISTEN_FDS)")
+	}
+	return res, nil
+}
+
+// systemdInput creates an input for an inherited socket, the file can be closed afterwards.
+func systemdInput(f *os.File, tag string) (inputSource, error) {
+	if pc, err := net.FilePacketConn(f); err == nil {
+		c, ok := pc.(*net.UDPConn)
+		if !ok {
+			pc.Close()
+			return nil, errors.Errorf("%s: unsupported socket type %T", f.Name(), pc)
+		}
+		if err := setRcvBuf(c); err != nil {
+			c.Close()
+			return nil, errors.Trace(err)
+		}
+		in := &udpInput{c: c, tag: tag}
+		if err := enableRxqOvfl(c); err == nil {
+			in.dropAcct = true
+		}
+		klog.Infof("Listening on UDP %s (from systemd)...", c.LocalAddr())
+		return in, nil
+	}
+	if l, err := net.FileListener(f); err == nil {
+		klog.Infof("Listening on %s (from systemd)...", l.Addr())
+		return &tcpInput{l: l, tag: tag}, nil
+	}
+	return nil, errors.Errorf("%s: unsupported socket type", f.Name())
+}
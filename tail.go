@@ -0,0 +1,123 @@
+/*
+ * Copyright (c) 2022 Deomid "rojer" Ryabkov
+ * All rights reserved
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"container/list"
+	"sync"
+)
+
+// Least recently active devices without followers are evicted.
+const tailMaxDevices = 1024
+
+// TailBuffer keeps the most recent lines of each device in memory.
+type TailBuffer struct {
+	size    int
+	mu      sync.Mutex
+	devices map[string]*list.Element // Elements of lru.
+	lru     list.List                // *tailRing, most recently written first.
+}
+
+type tailRing struct {
+	deviceID string
+	lines    []*LineInfo
+	next     int
+	subs     map[chan *LineInfo]bool
+}
+
+func NewTailBuffer(size int) *TailBuffer {
+	return &TailBuffer{
+		size:    size,
+		devices: make(map[string]*list.Element),
+	}
+}
+
+func (tb *TailBuffer) WriteLine(li *LineInfo) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	el := tb.devices[li.DeviceID]
+	if el == nil {
+		el = tb.lru.PushFront(&tailRing{deviceID: li.DeviceID, subs: make(map[chan *LineInfo]bool)})
+		tb.devices[li.DeviceID] = el
+		if tb.lru.Len() > tailMaxDevices {
+			tb.evictLocked()
+		}
+	} else {
+		tb.lru.MoveToFront(el)
+	}
+	tr := el.Value.(*tailRing)
+	if len(tr.lines) < tb.size {
+		tr.lines = append(tr.lines, li)
+	} else {
+		tr.lines[tr.next] = li
+		tr.next = (tr.next + 1) % tb.size
+	}
+	for ch := range tr.subs {
+		// Slow readers miss lines rather than holding everyone up.
+		select {
+		case ch <- li:
+		default:
+		}
+	}
+}
+
+// evictLocked removes the least recently written ring that nobody follows.
+func (tb *TailBuffer) evictLocked() {
+	for el := tb.lru.Back(); el != nil; el = el.Prev() {
+		if tr := el.Value.(*tailRing); len(tr.subs) == 0 {
+			delete(tb.devices, tr.deviceID)
+			tb.lru.Remove(el)
+			return
+		}
+	}
+}
+
+// Get returns up to n last lines of the device, oldest first.
+// If follow is true, also returns a channel that receives subsequent lines,
+// it must be released with Unfollow.
+func (tb *TailBuffer) Get(deviceID string, n int, follow bool) ([]*LineInfo, chan *LineInfo, bool) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	el := tb.devices[deviceID]
+	if el == nil {
+		return nil, nil, false
+	}
+	tr := el.Value.(*tailRing)
+	lines := append(append([]*LineInfo(nil), tr.lines[tr.next:]...), tr.lines[:tr.next]...)
+	if n >= 0 && n < len(lines) {
+		lines = lines[len(lines)-n:]
+	}
+	var ch chan *LineInfo
+	if follow {
+		ch = make(chan *LineInfo, 100)
+		tr.subs[ch] = true
+	}
+	return lines, ch, true
+}
+
+func (tb *TailBuffer) Unfollow(deviceID string, ch chan *LineInfo) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	if el := tb.devices[deviceID]; el != nil {
+		delete(el.Value.(*tailRing).subs, ch)
+	}
+}
+
+func (tb *TailBuffer) Close() error {
+	return nil
+}
@@ -0,0 +1,92 @@
+/*
+ * Copyright (c) 2022 Deomid "rojer" Ryabkov
+ * All rights reserved
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"net"
+	"time"
+
+	"github.com/juju/errors"
+	klog "k8s.io/klog/v2"
+)
+
+// tcpInput accepts connections and reads newline-delimited log lines from them.
+type tcpInput struct {
+	l   net.Listener
+	tag string
+	// Expect PROXY protocol header at the start of connections.
+	proxy bool
+	// If set, connections are TLS-encrypted (after the PROXY header, if any).
+	tlsConfig *tls.Config
+}
+
+// Time allowed for a client to send the PROXY header.
+const proxyHeaderTimeout = 10 * time.Second
+
+func listenTCP(network, addr, tag string, proxy bool) (*tcpInput, error) {
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	klog.Infof("Listening on TCP %s...", l.Addr())
+	return &tcpInput{l: l, tag: tag, proxy: proxy}, nil
+}
+
+func (in *tcpInput) Run(wp *WorkerPool) error {
+	for {
+		c, err := in.l.Accept()
+		if err != nil {
+			return errors.Annotatef(err, "accept error")
+		}
+		go in.serve(c, wp)
+	}
+}
+
+func (in *tcpInput) serve(c net.Conn, wp *WorkerPool) {
+	defer c.Close()
+	klog.V(1).Infof("%s: connected", c.RemoteAddr())
+	src := c.RemoteAddr()
+	if in.proxy {
+		br := bufio.NewReader(c)
+		c.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		addr, err := readProxyHeader(br)
+		if err != nil {
+			klog.Errorf("%s: %v", c.RemoteAddr(), err)
+			return
+		}
+		c.SetReadDeadline(time.Time{})
+		if addr != nil {
+			klog.V(1).Infof("%s: proxied connection from %s", c.RemoteAddr(), addr)
+			src = addr
+		}
+		c = &bufConn{Conn: c, r: br}
+	}
+	if in.tlsConfig != nil {
+		c = tls.Server(c, in.tlsConfig)
+	}
+	if err := readLines(c, streamSrc(src), in.tag, wp); err != nil {
+		klog.Errorf("%s: read error: %v", src, err)
+	}
+	klog.V(1).Infof("%s: disconnected", src)
+}
+
+func (in *tcpInput) Close() error {
+	return in.l.Close()
+}
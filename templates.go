@@ -0,0 +1,103 @@
+/*
+ * Copyright (c) 2022 Deomid "rojer" Ryabkov
+ * All rights reserved
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"text/template"
+	"unicode/utf8"
+)
+
+// Functions available in all the templates.
+var tmplFuncs = template.FuncMap{
+	"upper":   strings.ToUpper,
+	"lower":   strings.ToLower,
+	"pad":     tmplPad,
+	"trunc":   tmplTrunc,
+	"default": tmplDefault,
+	"json":    tmplJSON,
+	"logfmt":  tmplLogfmt,
+}
+
+// Record formats that have names, other than json.
+var namedFormats = map[string]string{
+	"logfmt": "{{logfmt .}}",
+}
+
+// recordFormat turns a line into a record.
+type recordFormat interface {
+	Format(li *LineInfo) (string, error)
+}
+
+// tmplFormat formats records with a template.
+type tmplFormat struct {
+	t *template.Template
+}
+
+func (f tmplFormat) Format(li *LineInfo) (string, error) {
+	return execTmpl(f.t, li)
+}
+
+func newTemplate(name string) *template.Template {
+	return template.New(name).Funcs(tmplFuncs)
+}
+
+// parseRecordFormat parses a record template, which can also be one of the named formats.
+// json records are encoded directly, without a template.
+func parseRecordFormat(name, format string) (recordFormat, error) {
+	if format == "json" {
+		return jsonFormat{}, nil
+	}
+	if nf, ok := namedFormats[format]; ok {
+		format = nf
+	}
+	t, err := newTemplate(name).Parse(format)
+	if err != nil {
+		return nil, err
+	}
+	return tmplFormat{t}, nil
+}
+
+// trimRecordSep removes the record separator from the end of an executed record template,
+// so that it is not doubled if the template ends with it.
+func trimRecordSep(rec, sep string) string {
+	return strings.TrimSuffix(rec, sep)
+}
+
+// pad N s: pads s with spaces to N characters, negative N pads on the left.
+func tmplPad(n int, v interface{}) string {
+	return fmt.Sprintf("%*v", -n, v)
+}
+
+// trunc N s: truncates s to N characters.
+func tmplTrunc(n int, s string) string {
+	if n < 0 || utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return string([]rune(s)[:n])
+}
+
+// default d v: returns d if v is empty.
+func tmplDefault(d, v interface{}) interface{} {
+	if v == nil || reflect.ValueOf(v).IsZero() {
+		return d
+	}
+	return v
+}
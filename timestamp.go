@@ -17,6 +17,7 @@
 package main
 
 import (
+	"fmt"
 	"time"
 )
 
@@ -68,3 +69,16 @@ func FormatTimestamp(ts time.Time) string {
 	}
 	return ts.Format(tsFormat)
 }
+
+// FormatUptime formats uptime as 1h02m03.456s.
+func FormatUptime(ms uint64) string {
+	h, m, sec, msec := ms/3600000, ms/60000%60, ms/1000%60, ms%1000
+	switch {
+	case h > 0:
+		return fmt.Sprintf("%dh%02dm%02d.%03ds", h, m, sec, msec)
+	case m > 0:
+		return fmt.Sprintf("%dm%02d.%03ds", m, sec, msec)
+	default:
+		return fmt.Sprintf("%d.%03ds", sec, msec)
+	}
+}
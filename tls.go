@@ -0,0 +1,44 @@
+/*
+ * Copyright (c) 2022 Deomid "rojer" Ryabkov
+ * All rights reserved
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"net"
+
+	"github.com/juju/errors"
+	klog "k8s.io/klog/v2"
+)
+
+// listenTLS is like listenTCP, but connections are TLS-encrypted.
+func listenTLS(addr, tag, certFile, keyFile string, proxy bool) (*tcpInput, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, errors.Errorf("--tls-cert and --tls-key are required for tls://")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, errors.Annotatef(err, "failed to load TLS certificate")
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	klog.Infof("Listening on TLS %s...", l.Addr())
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert}}
+	return &tcpInput{l: l, tag: tag, proxy: proxy, tlsConfig: cfg}, nil
+}
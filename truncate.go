@@ -0,0 +1,36 @@
+/*
+ * Copyright (c) 2022 Deomid "rojer" Ryabkov
+ * All rights reserved
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"unicode/utf8"
+)
+
+// truncateMsg cuts s to at most maxLen bytes (not splitting UTF-8 sequences)
+// and appends a marker with the number of bytes removed.
+func truncateMsg(s string, maxLen int) (string, bool) {
+	if maxLen <= 0 || len(s) <= maxLen {
+		return s, false
+	}
+	n := maxLen
+	for n > 0 && n < len(s) && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return fmt.Sprintf("%s…[truncated %d bytes]", s[:n], len(s)-n), true
+}
@@ -0,0 +1,74 @@
+/*
+ * Copyright (c) 2022 Deomid "rojer" Ryabkov
+ * All rights reserved
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"net"
+	"os"
+
+	"github.com/juju/errors"
+	klog "k8s.io/klog/v2"
+)
+
+// Source address reported for lines received over Unix sockets.
+var unixSrc = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+
+// unixgramInput receives datagrams on a Unix socket.
+type unixgramInput struct {
+	c    *net.UnixConn
+	path string
+	tag  string
+}
+
+func listenUnixgram(path, tag string) (*unixgramInput, error) {
+	if path == "" {
+		return nil, errors.Errorf("socket path is required, e.g. unixgram:///run/udplog.sock")
+	}
+	// Remove a stale socket left behind by a previous instance, but nothing else.
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	c, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err := setRcvBuf(c); err != nil {
+		c.Close()
+		return nil, errors.Trace(err)
+	}
+	klog.Infof("Listening on %s...", path)
+	return &unixgramInput{c: c, path: path, tag: tag}, nil
+}
+
+func (in *unixgramInput) Run(wp *WorkerPool) error {
+	for {
+		buf := pktBufPool.Get().(*[]byte)
+		n, _, err := in.c.ReadFromUnix(*buf)
+		if err != nil {
+			pktBufPool.Put(buf)
+			return errors.Annotatef(err, "socket read error")
+		}
+		enqueueDatagram(buf, n, unixSrc, in.tag, wp)
+	}
+}
+
+func (in *unixgramInput) Close() error {
+	err := in.c.Close()
+	os.Remove(in.path)
+	return err
+}
@@ -0,0 +1,169 @@
+/*
+ * Copyright (c) 2022 Deomid "rojer" Ryabkov
+ * All rights reserved
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	klog "k8s.io/klog/v2"
+)
+
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocket opcodes.
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+)
+
+// wsIngestHandler accepts log lines over WebSocket, each message contains one or more lines.
+// This is a minimal server-side RFC 6455 implementation, without extensions.
+type wsIngestHandler struct {
+	wp *WorkerPool
+}
+
+func (h *wsIngestHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") || key == "" {
+		http.Error(w, "WebSocket upgrade required", http.StatusBadRequest)
+		return
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "WebSocket is not supported", http.StatusInternalServerError)
+		return
+	}
+	c, rw, err := hj.Hijack()
+	if err != nil {
+		klog.Errorf("%s: hijack failed: %v", r.RemoteAddr, err)
+		return
+	}
+	defer c.Close()
+	sum := sha1.Sum([]byte(key + wsGUID))
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n")
+	rw.WriteString("Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n\r\n")
+	if err := rw.Flush(); err != nil {
+		return
+	}
+	klog.V(1).Infof("%s: WebSocket connected", r.RemoteAddr)
+	if err := h.serve(c, rw.Reader, httpSrc(r)); err != nil && err != io.EOF {
+		klog.Errorf("%s: WebSocket error: %v", r.RemoteAddr, err)
+	}
+	klog.V(1).Infof("%s: WebSocket disconnected", r.RemoteAddr)
+}
+
+func (h *wsIngestHandler) serve(c net.Conn, r *bufio.Reader, src *net.UDPAddr) error {
+	var msg []byte
+	for {
+		fin, opcode, payload, err := wsReadFrame(r)
+		if err != nil {
+			return err
+		}
+		switch opcode {
+		case wsText, wsBinary, wsContinuation:
+			msg = append(msg, payload...)
+			if len(msg) > maxStreamLineLen {
+				return errors.Errorf("message is too big")
+			}
+			if !fin {
+				continue
+			}
+			if len(msg) > 0 {
+				if msg[len(msg)-1] != '\n' {
+					msg = append(msg, '\n')
+				}
+				rxPackets.Add(1)
+				rxBytes.Add(int64(len(msg)))
+				h.wp.EnqueueWait(&packet{ts: time.Now(), src: src, data: msg, listener: "ws"})
+			}
+			msg = nil
+		case wsPing:
+			if err := wsWriteFrame(c, wsPong, payload); err != nil {
+				return err
+			}
+		case wsClose:
+			wsWriteFrame(c, wsClose, nil)
+			return nil
+		}
+	}
+}
+
+func wsReadFrame(r *bufio.Reader) (bool, byte, []byte, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin, opcode := hdr[0]&0x80 != 0, hdr[0]&0x0f
+	masked := hdr[1]&0x80 != 0
+	n := uint64(hdr[1] & 0x7f)
+	switch n {
+	case 126:
+		var b [2]byte
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return false, 0, nil, err
+		}
+		n = uint64(binary.BigEndian.Uint16(b[:]))
+	case 127:
+		var b [8]byte
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return false, 0, nil, err
+		}
+		n = binary.BigEndian.Uint64(b[:])
+	}
+	if n > maxStreamLineLen {
+		return false, 0, nil, errors.Errorf("frame is too big (%d)", n)
+	}
+	var mask [4]byte
+	if masked {
+		if _, err := io.ReadFull(r, mask[:]); err != nil {
+			return false, 0, nil, err
+		}
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return false, 0, nil, err
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return fin, opcode, payload, nil
+}
+
+// wsWriteFrame writes a short unmasked control frame.
+func wsWriteFrame(w io.Writer, opcode byte, payload []byte) error {
+	if len(payload) > 125 {
+		payload = payload[:125]
+	}
+	_, err := w.Write(append([]byte{0x80 | opcode, byte(len(payload))}, payload...))
+	return err
+}
@@ -0,0 +1,99 @@
+/*
+ * Copyright (c) 2022 Deomid "rojer" Ryabkov
+ * All rights reserved
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"hash/fnv"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/rojer/mos_udp_log_catcher/logline"
+)
+
+type packet struct {
+	ts   time.Time
+	src  *net.UDPAddr
+	data []byte
+	buf  *[]byte // Backing buffer from pktBufPool, if any.
+	// Tag of the listener that received the packet.
+	listener string
+	// Received as a datagram, may be compressed.
+	datagram bool
+	// Already parsed line, for inputs that do not use the line format. data is not used.
+	li *logline.LineInfo
+}
+
+// Receive buffers are recycled to reduce allocations.
+var pktBufPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, *flagMaxPktSize)
+		return &b
+	},
+}
+
+// release returns the packet's buffer to the pool, data must not be used after that.
+func (p *packet) release() {
+	if p.buf != nil {
+		pktBufPool.Put(p.buf)
+		p.buf, p.data = nil, nil
+	}
+}
+
+// WorkerPool processes packets in the background.
+// Packets from the same source are always handled by the same worker, so their order is preserved.
+type WorkerPool struct {
+	queues []chan *packet
+}
+
+func NewWorkerPool(numWorkers, queueSize int, handle func(p *packet)) *WorkerPool {
+	wp := &WorkerPool{}
+	for i := 0; i < numWorkers; i++ {
+		q := make(chan *packet, queueSize)
+		wp.queues = append(wp.queues, q)
+		go func() {
+			for p := range q {
+				handle(p)
+				p.release()
+			}
+		}()
+	}
+	return wp
+}
+
+func (wp *WorkerPool) queueFor(src *net.UDPAddr) chan *packet {
+	h := fnv.New32a()
+	h.Write(src.IP)
+	h.Write([]byte{byte(src.Port >> 8), byte(src.Port)})
+	return wp.queues[h.Sum32()%uint32(len(wp.queues))]
+}
+
+// Enqueue queues the packet for processing, returns false if the queue is full.
+func (wp *WorkerPool) Enqueue(p *packet) bool {
+	select {
+	case wp.queueFor(p.src) <- p:
+		return true
+	default:
+		return false
+	}
+}
+
+// EnqueueWait queues the packet for processing, waiting for space in the queue if necessary.
+func (wp *WorkerPool) EnqueueWait(p *packet) {
+	wp.queueFor(p.src) <- p
+}